@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultMaxQueries is the number of queries a single resolution may send unless a Resolver specifies another.
+	DefaultMaxQueries = 100
+	// DefaultMaxDuration is how long a single resolution may take unless a Resolver specifies another.
+	DefaultMaxDuration = 30 * time.Second
+)
+
+// budget limits the work done by a single resolution, including every resolution nested within it
+// to resolve the addresses of name servers without glue. It protects against zones whose delegations
+// depend on each other, which would otherwise make the resolver send queries forever.
+type budget struct {
+	// queries is the number of queries that may still be sent.
+	queries    int
+	maxQueries int
+	maxDepth   int
+	// refresh is set to resolve the question of the resolution again rather than answer it from the
+	// cache. Nested resolutions still use the cache.
+	refresh bool
+	// trace, if not nil, receives a step for every query sent by the resolution.
+	trace *Trace
+}
+
+func (r *Resolver) newBudget() *budget {
+	maxQueries := r.MaxQueries
+	if maxQueries <= 0 {
+		maxQueries = DefaultMaxQueries
+	}
+	return &budget{queries: maxQueries, maxQueries: maxQueries, maxDepth: r.maxDepth()}
+}
+
+func (r *Resolver) maxDuration() time.Duration {
+	if r.MaxDuration <= 0 {
+		return DefaultMaxDuration
+	}
+	return r.MaxDuration
+}
+
+// enter returns an error if a resolution nested depth levels deep would exceed the budget.
+func (b *budget) enter(domainName string, depth int) error {
+	if depth > b.maxDepth {
+		return fmt.Errorf("%w: %w resolving %s", ErrBudgetExceeded, ErrMaxDepth, domainName)
+	}
+	return nil
+}
+
+// spend accounts for a query that is about to be sent, and returns an error if no queries are left.
+func (b *budget) spend(domainName string) error {
+	if b.queries <= 0 {
+		return fmt.Errorf("%w: sent %d queries resolving %s", ErrBudgetExceeded, b.maxQueries, domainName)
+	}
+	b.queries--
+	return nil
+}
+
+// exhausted reports whether every query of the budget has been sent.
+func (b *budget) exhausted() bool {
+	return b.queries <= 0
+}
+
+// withDuration limits the context to the longest time a resolution may take.
+// The returned function converts errors caused by reaching that limit, rather than by the deadline
+// of the original context, into errors matching ErrBudgetExceeded.
+func (r *Resolver) withDuration(ctx context.Context) (context.Context, context.CancelFunc, func(domainName string, err error) error) {
+	parent := ctx
+	maxDuration := r.maxDuration()
+	ctx, cancel := context.WithTimeout(ctx, maxDuration)
+	convert := func(domainName string, err error) error {
+		// Queries that time out also report context.DeadlineExceeded, so check which context has expired.
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil && parent.Err() == nil {
+			return fmt.Errorf("%w: took longer than %v resolving %s: %w", ErrBudgetExceeded, maxDuration, domainName, err)
+		}
+		return err
+	}
+	return ctx, cancel, convert
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestResolver_Lookup_budget(t *testing.T) {
+	t.Run("circular delegations", func(t *testing.T) {
+		resolver := fakeHierarchy()
+		_, err := resolver.Lookup(context.Background(), "www.a.test", "A")
+		if !errors.Is(err, ErrBudgetExceeded) || !errors.Is(err, ErrMaxDepth) {
+			t.Errorf("expected error %v and %v, got %v", ErrBudgetExceeded, ErrMaxDepth, err)
+		}
+	})
+
+	t.Run("queries", func(t *testing.T) {
+		resolver := fakeHierarchy()
+		resolver.MaxDepth = 100
+		resolver.MaxQueries = 10
+		counts := countQueries(resolver)
+		_, err := resolver.Lookup(context.Background(), "www.a.test", "A")
+		if !errors.Is(err, ErrBudgetExceeded) || errors.Is(err, ErrMaxDepth) {
+			t.Errorf("expected error %v only, got %v", ErrBudgetExceeded, err)
+		}
+		queries := 0
+		for _, count := range counts {
+			queries += count
+		}
+		if queries != resolver.MaxQueries {
+			t.Errorf("expected %d queries to be sent, got %d", resolver.MaxQueries, queries)
+		}
+	})
+
+	t.Run("last query spent resolving a name server", func(t *testing.T) {
+		// Resolving www.example.com takes two queries before its glueless name server is resolved
+		// with three more, which leaves none for the query to that name server.
+		resolver := fakeHierarchy()
+		resolver.MaxQueries = 5
+		resolver.Retries = 2
+		start := time.Now()
+		_, err := resolver.Lookup(context.Background(), "www.example.com", "A")
+		if !errors.Is(err, ErrBudgetExceeded) || errors.Is(err, ErrServersFailed) {
+			t.Errorf("expected error %v, got %v", ErrBudgetExceeded, err)
+		}
+		if elapsed := time.Since(start); elapsed >= DefaultRetryBackoff {
+			t.Errorf("expected the resolution to stop without retrying, took %v", elapsed)
+		}
+	})
+
+	// unresponsive returns a resolver whose only root server never answers.
+	unresponsive := func() *Resolver {
+		root := netip.MustParseAddr("192.0.2.1")
+		return &Resolver{
+			RootHints: []netip.Addr{root},
+			Transport: &MemoryTransport{Servers: map[netip.AddrPort]Handler{
+				netip.AddrPortFrom(root, DefaultPort): func(ctx context.Context, query Message) (Message, error) {
+					<-ctx.Done()
+					return Message{}, ctx.Err()
+				},
+			}},
+		}
+	}
+
+	t.Run("duration", func(t *testing.T) {
+		resolver := unresponsive()
+		resolver.MaxDuration = 50 * time.Millisecond
+		_, err := resolver.Lookup(context.Background(), "www.example.com", "A")
+		if !errors.Is(err, ErrBudgetExceeded) {
+			t.Errorf("expected error %v, got %v", ErrBudgetExceeded, err)
+		}
+	})
+
+	t.Run("query timeout", func(t *testing.T) {
+		resolver := unresponsive()
+		resolver.Timeout = 10 * time.Millisecond
+		_, err := resolver.Lookup(context.Background(), "www.example.com", "A")
+		if !errors.Is(err, ErrServersFailed) || errors.Is(err, ErrBudgetExceeded) {
+			t.Errorf("expected error %v, got %v", ErrServersFailed, err)
+		}
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := unresponsive().Lookup(ctx, "www.example.com", "A")
+		if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrBudgetExceeded) {
+			t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+}
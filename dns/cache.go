@@ -0,0 +1,415 @@
+package dns
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the number of RRsets held by the cache of DefaultResolver.
+const DefaultCacheSize = 10000
+
+// maxCacheTTL caps how long records are cached, whatever their TTL,
+// as recommended by [RFC 8767 section 4].
+//
+// [RFC 8767 section 4]: https://datatracker.ietf.org/doc/html/rfc8767#section-4
+const maxCacheTTL = 7 * 24 * time.Hour
+
+// maxNegativeTTL caps how long negative answers are cached, as suggested by [RFC 2308 section 5].
+//
+// [RFC 2308 section 5]: https://datatracker.ietf.org/doc/html/rfc2308#section-5
+const maxNegativeTTL = 3 * time.Hour
+
+// anyType is the record type in the key of a cached NXDOMAIN response,
+// which applies to every type of record owned by the name.
+const anyType = 0
+
+// staleTTL is the TTL given to records served after their TTL has run out,
+// as recommended by [RFC 8767 section 4].
+//
+// [RFC 8767 section 4]: https://datatracker.ietf.org/doc/html/rfc8767#section-4
+const staleTTL = 30
+
+// prefetchFraction is the fraction of its TTL that an RRset must have left before it is prefetched.
+const prefetchFraction = 10
+
+// Cache holds the RRsets learned by a Resolver until their TTLs run out, so that later resolutions
+// can be answered, or started at the closest known name servers, without repeating queries.
+// When the cache is full, the least recently used RRset is evicted to make room for a new one.
+// A Cache is safe for concurrent use.
+type Cache struct {
+	// MaxStale is how long RRsets are kept after their TTL has run out, so that they can still be
+	// used to answer when the name servers that hold them cannot be reached, as described in
+	// [RFC 8767]. If zero, RRsets are removed as soon as they expire.
+	// It must not be modified while the cache is in use.
+	//
+	// [RFC 8767]: https://datatracker.ietf.org/doc/html/rfc8767
+	MaxStale time.Duration
+
+	mu       sync.Mutex
+	capacity int
+	// entries maps the key of each RRset to its element in lru.
+	entries map[cacheKey]*list.Element
+	// lru holds a *cacheEntry for each RRset, from the most to the least recently used.
+	lru *list.List
+	// now returns the current time, and is replaced in tests.
+	now func() time.Time
+}
+
+// cacheKey identifies an RRset. The name is in its canonical form.
+type cacheKey struct {
+	name  string
+	rtype uint16
+	class uint16
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// records holds the RRset, or the SOA record of the zone for a negative answer.
+	records []Record
+	// err is the error for a negative answer, or nil for an RRset.
+	err     *ResponseError
+	stored  time.Time
+	expires time.Time
+	// hits is the number of times the entry has been used to answer a question before it expired.
+	hits int
+	// prefetched is set once the entry has been returned for prefetching.
+	prefetched bool
+}
+
+// NewCache returns an empty cache that holds up to capacity RRsets.
+// If capacity is zero or less, DefaultCacheSize is used.
+func NewCache(capacity int) *Cache {
+	if capacity <= 0 {
+		capacity = DefaultCacheSize
+	}
+	return &Cache{
+		capacity: capacity,
+		entries:  map[cacheKey]*list.Element{},
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// Len returns the number of RRsets in the cache, including any that have expired
+// but have not been removed yet, such as those kept to be served stale.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Get returns the cached RRset of the given type and class owned by a domain name, with the TTL
+// of each record reduced by the time it has spent in the cache. It reports false if there is no
+// such RRset, or if its TTL has run out.
+func (c *Cache) Get(domainName string, recordType uint16, class uint16) ([]Record, bool) {
+	entry, ok := c.get(cacheKey{name: canonicalName(domainName), rtype: recordType, class: class}, false)
+	return entry.records, ok && entry.err == nil
+}
+
+// cached is an entry returned by get.
+type cached struct {
+	records []Record
+	err     *ResponseError
+}
+
+// get returns the records and error of the entry with the given key, with the TTL of each record
+// reduced by the time it has spent in the cache. It reports false if there is no such entry, or if
+// it has expired. If stale is true, entries that expired less than MaxStale ago are returned too,
+// with the TTL of their records set to staleTTL.
+func (c *Cache) get(key cacheKey, stale bool) (cached, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return cached{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	now := c.now()
+	expired := !now.Before(entry.expires)
+	if expired && !now.Before(entry.expires.Add(c.MaxStale)) {
+		c.remove(element)
+		return cached{}, false
+	}
+	if expired && !stale {
+		return cached{}, false
+	}
+	c.lru.MoveToFront(element)
+
+	result := cached{records: make([]Record, len(entry.records)), err: entry.err}
+	elapsed := int32(now.Sub(entry.stored) / time.Second)
+	for i, record := range entry.records {
+		record.TTL -= elapsed
+		if expired {
+			record.TTL = staleTTL
+		}
+		result.records[i] = record
+	}
+	return result, true
+}
+
+// hit counts a use of the fresh entry with the given key to answer a question. It reports true
+// the first time the entry is popular and has less than a tenth of its TTL left, so that it is
+// prefetched only once. Only answers count, as the name server lookups that share the entries
+// of the cache would not prefetch them.
+func (c *Cache) hit(key cacheKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	entry := element.Value.(*cacheEntry)
+	now := c.now()
+	if !now.Before(entry.expires) {
+		return false
+	}
+	entry.hits++
+	if entry.hits > 1 && !entry.prefetched && entry.expires.Sub(now) < entry.expires.Sub(entry.stored)/prefetchFraction {
+		entry.prefetched = true
+		return true
+	}
+	return false
+}
+
+// Put stores records in the cache, grouped into RRsets by owner name, type and class. Each RRset
+// replaces any RRset already cached with the same owner name, type and class, and expires once the
+// lowest TTL among its records has passed. RRsets whose TTL is zero are not cached.
+func (c *Cache) Put(records []Record) {
+	var keys []cacheKey
+	rrsets := map[cacheKey][]Record{}
+	for _, record := range records {
+		key := cacheKey{name: canonicalName(string(record.Name)), rtype: record.Type, class: record.Class}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], record)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for _, key := range keys {
+		rrset := rrsets[key]
+		ttl := maxCacheTTL
+		for _, record := range rrset {
+			if t := time.Duration(record.TTL) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+		if ttl <= 0 {
+			continue
+		}
+		for i := range rrset {
+			rrset[i].TTL = int32(ttl / time.Second)
+		}
+		c.add(&cacheEntry{key: key, records: rrset, stored: now, expires: now.Add(ttl)})
+	}
+}
+
+// add stores an entry as the most recently used one, evicting the least recently used entries
+// if the cache is full. It must be called with c.mu held.
+func (c *Cache) add(entry *cacheEntry) {
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes an entry from the cache. It must be called with c.mu held.
+func (c *Cache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// answer looks for the answer to a question in the cache, following any cached aliases. It returns
+// the CNAME records of the chain that was followed, and the records of the queried type owned by
+// the name at its end, if they are cached. If a negative answer is cached for the name at the end
+// of the chain, its *ResponseError is returned instead. If stale is true, entries whose TTL has run
+// out within MaxStale are used as well. The returned prefetch flag reports that an RRset of the
+// answer is popular and about to expire, so the question should be resolved again to refresh it.
+// A nil cache holds nothing.
+func (c *Cache) answer(domainName string, recordType uint16, stale bool) (chain []Record, answers []Record, prefetch bool, err error) {
+	if c == nil {
+		return nil, nil, false, nil
+	}
+	name := domainName
+	for len(chain) <= maxCNAMEChain {
+		key := cacheKey{name: canonicalName(name), rtype: recordType, class: ClassIn}
+		if entry, ok := c.get(key, stale); ok && entry.err == nil {
+			return chain, entry.records, c.hit(key) || prefetch, nil
+		}
+		if err := c.negative(name, recordType, stale); err != nil {
+			return nil, nil, false, err
+		}
+		if recordType == TypeCNAME {
+			break
+		}
+		key = cacheKey{name: canonicalName(name), rtype: TypeCNAME, class: ClassIn}
+		entry, ok := c.get(key, stale)
+		if !ok || entry.err != nil {
+			break
+		}
+		cname, ok := entry.records[0].Data.(*CNAME)
+		if !ok {
+			break
+		}
+		chain = append(chain, entry.records[0])
+		prefetch = c.hit(key) || prefetch
+		name = cname.Target
+	}
+	return chain, nil, false, nil
+}
+
+// negative returns the cached negative answer for records of the given type owned by a domain name:
+// a *ResponseError matching ErrNXDomain if the name does not exist, or ErrNoData if it has no such
+// records. The SOA record of the error has its TTL reduced by the time it has spent in the cache.
+// If stale is true, negative answers whose TTL has run out within MaxStale are returned as well.
+// It returns nil if no negative answer is cached.
+func (c *Cache) negative(domainName string, recordType uint16, stale bool) error {
+	name := canonicalName(domainName)
+	for _, rtype := range []uint16{anyType, recordType} {
+		entry, ok := c.get(cacheKey{name: name, rtype: rtype, class: ClassIn}, stale)
+		if ok && entry.err != nil {
+			err := *entry.err
+			err.SOA = &entry.records[0]
+			return &err
+		}
+	}
+	return nil
+}
+
+// storeNegative caches the negative answer of a response for which checkResponse returned an
+// error matching ErrNXDomain or ErrNoData, as described in [RFC 2308 section 5]. It is cached
+// for the lower of the TTL and the MINIMUM field of the SOA record in the authority section,
+// and not at all if there is no SOA record. An NXDOMAIN response applies to every record type
+// of the name. If the response followed aliases, the negative answer applies to the name at the
+// end of the chain, and the aliases themselves are cached as well. Like storeResponse, only aliases
+// and negative answers for names inside the zone of the responding name server are cached.
+// A nil cache stores nothing.
+//
+// [RFC 2308 section 5]: https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func (c *Cache) storeNegative(response Message, err error, zone string) {
+	var responseErr *ResponseError
+	if c == nil || !errors.As(err, &responseErr) || len(response.Questions) == 0 {
+		return
+	}
+	nxdomain := errors.Is(err, ErrNXDomain)
+	soa := GetSOA(response)
+	if soa == nil || !nxdomain && !errors.Is(err, ErrNoData) {
+		return
+	}
+
+	question := response.Questions[0]
+	name := string(question.Name)
+	chain, _ := followZoneAliases(response, zone)
+	if len(chain) > 0 {
+		c.Put(chain)
+		name = aliasTarget(chain)
+	}
+	if !isSubdomain(name, zone) {
+		return
+	}
+	ttl := time.Duration(soa.TTL) * time.Second
+	if minimum := time.Duration(soa.Data.(*SOA).Minimum) * time.Second; minimum < ttl {
+		ttl = minimum
+	}
+	if ttl > maxNegativeTTL {
+		ttl = maxNegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	key := cacheKey{name: canonicalName(name), rtype: question.Type, class: question.Class}
+	if nxdomain {
+		key.rtype = anyType
+	}
+	cached := *responseErr
+	cached.Name = name
+	record := *soa
+	record.TTL = int32(ttl / time.Second)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.add(&cacheEntry{key: key, records: []Record{record}, err: &cached, stored: now, expires: now.Add(ttl)})
+}
+
+// delegation returns the name servers of the closest zone enclosing the domain name whose
+// NS records are cached, along with the addresses of any cached glue, ordered like referralServers,
+// and the name of the zone. It returns nil if no enclosing zone other than the root is cached.
+func (c *Cache) delegation(domainName string) ([]nameserver, string) {
+	if c == nil {
+		return nil, ""
+	}
+	for zone := canonicalName(domainName); zone != ""; zone = parentName(zone) {
+		ns, ok := c.Get(zone, TypeNS, ClassIn)
+		if !ok {
+			continue
+		}
+		referral := Message{Authorities: ns}
+		for _, record := range ns {
+			if host, ok := record.Data.(*NS); ok {
+				for _, recordType := range []uint16{TypeA, TypeAAAA} {
+					glue, _ := c.Get(host.Host, recordType, ClassIn)
+					referral.Additionals = append(referral.Additionals, glue...)
+				}
+			}
+		}
+		return referralServers(referral), zone
+	}
+	return nil, ""
+}
+
+// storeResponse caches the records of a response from a name server of the zone that answer its
+// question, including any chain of aliases, or the NS records and glue of a referral. To keep a name
+// server from planting records for names it is not responsible for, only answers and aliases owned
+// by names inside the zone, only the NS records of a zone strictly below it that encloses the
+// question, and only glue for name servers inside the delegated zone, are cached.
+// A nil cache stores nothing.
+func (c *Cache) storeResponse(response Message, zone string) {
+	if c == nil || len(response.Questions) == 0 {
+		return
+	}
+	if chain, answers := followZoneAliases(response, zone); len(chain) > 0 || len(answers) > 0 {
+		c.Put(append(chain[:len(chain):len(chain)], answers...))
+		return
+	}
+	if !isReferral(response) || checkReferral("", response, zone) != nil {
+		return
+	}
+	delegated := referralZone(response)
+	ns := FilterByName(FilterByType(response.Authorities, TypeNS), delegated)
+	records := ns
+	for _, record := range ns {
+		host, ok := record.Data.(*NS)
+		if !ok || !isSubdomain(host.Host, delegated) {
+			continue
+		}
+		for _, glue := range FilterByName(response.Additionals, host.Host) {
+			if glue.Type == TypeA || glue.Type == TypeAAAA {
+				records = append(records, glue)
+			}
+		}
+	}
+	c.Put(records)
+}
+
+// isSubdomain reports whether a domain name is equal to, or below, the given zone.
+func isSubdomain(domainName string, zone string) bool {
+	name, zone := canonicalName(domainName), canonicalName(zone)
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// parentName returns the name of the domain directly above a domain name in canonical form,
+// which is the root, "", for top-level domains.
+func parentName(domainName string) string {
+	_, parent, _ := strings.Cut(domainName, ".")
+	return parent
+}
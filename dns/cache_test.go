@@ -0,0 +1,432 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock returns a time that only moves when advanced by the test.
+type fakeClock struct {
+	mu   sync.Mutex
+	time time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.time = c.time.Add(d)
+}
+
+// newTestCache returns a cache whose clock is controlled by the test.
+func newTestCache(capacity int) (*Cache, *fakeClock) {
+	clock := &fakeClock{time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := NewCache(capacity)
+	cache.now = clock.now
+	return cache, clock
+}
+
+// countQueries wraps every server of the resolver's MemoryTransport to count the queries it receives.
+func countQueries(resolver *Resolver) map[string]int {
+	counts := map[string]int{}
+	transport := resolver.Transport.(*MemoryTransport)
+	for server, handler := range transport.Servers {
+		server, handler := server, handler
+		transport.Servers[server] = func(ctx context.Context, query Message) (Message, error) {
+			counts[server.Addr().String()]++
+			return handler(ctx, query)
+		}
+	}
+	return counts
+}
+
+func TestCache_Get(t *testing.T) {
+	cache, clock := newTestCache(10)
+	a := func(ip string, ttl int32) Record {
+		record := testRecord("www.example.com", &A{Addr: netip.MustParseAddr(ip)})
+		record.TTL = ttl
+		return record
+	}
+	cache.Put([]Record{a("192.0.2.1", 300), a("192.0.2.2", 60)})
+	cache.Put([]Record{{Name: []byte("zero.example.com"), Type: TypeA, Class: ClassIn, TTL: 0, Data: &A{}}})
+
+	clock.advance(10 * time.Second)
+	got, ok := cache.Get("WWW.example.com.", TypeA, ClassIn)
+	if want := []Record{a("192.0.2.1", 50), a("192.0.2.2", 50)}; !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the RRset with the lowest TTL minus 10 seconds %v, got %v", want, got)
+	}
+	if _, ok := cache.Get("zero.example.com", TypeA, ClassIn); ok {
+		t.Error("expected records with a TTL of zero not to be cached")
+	}
+	if _, ok := cache.Get("www.example.com", TypeAAAA, ClassIn); ok {
+		t.Error("expected no AAAA records to be cached")
+	}
+
+	clock.advance(50 * time.Second)
+	if _, ok := cache.Get("www.example.com", TypeA, ClassIn); ok {
+		t.Error("expected the RRset to expire with its TTL")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected expired entries to be removed, got %d entries", cache.Len())
+	}
+}
+
+func TestCache_eviction(t *testing.T) {
+	cache, _ := newTestCache(2)
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		cache.Put([]Record{testRecord(name, &A{Addr: netip.MustParseAddr("192.0.2.1")})})
+	}
+	cache.Get("a.example.com", TypeA, ClassIn)
+	cache.Put([]Record{testRecord("c.example.com", &A{Addr: netip.MustParseAddr("192.0.2.1")})})
+
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", cache.Len())
+	}
+	for name, want := range map[string]bool{"a.example.com": true, "b.example.com": false, "c.example.com": true} {
+		if _, ok := cache.Get(name, TypeA, ClassIn); ok != want {
+			t.Errorf("expected %s to be cached: %v, got %v", name, want, ok)
+		}
+	}
+}
+
+func TestCache_storeResponse(t *testing.T) {
+	referral := func(question string, zone string, host string, glue string) Message {
+		return Message{
+			Questions:   []Question{{Name: []byte(question), Type: TypeA, Class: ClassIn}},
+			Authorities: []Record{testRecord(zone, &NS{Host: host})},
+			Additionals: []Record{testRecord(host, &A{Addr: netip.MustParseAddr(glue)})},
+		}
+	}
+	comReferral := referral("www.example.com", "example.com", "ns1.example.com", "192.0.2.1")
+	comReferral.Authorities = append(comReferral.Authorities, testRecord("example.com", &NS{Host: "ns.example.net"}))
+	comReferral.Additionals = append(comReferral.Additionals, testRecord("ns.example.net", &A{Addr: netip.MustParseAddr("203.0.113.66")}))
+
+	tests := []struct {
+		name     string
+		response Message
+		zone     string
+		lookup   string
+		want     []nameserver
+	}{
+		{
+			name:     "glue inside the delegated zone",
+			response: comReferral,
+			zone:     "com",
+			lookup:   "mail.example.com",
+			want: []nameserver{
+				{name: "ns1.example.com", addr: netip.MustParseAddr("192.0.2.1")},
+				{name: "ns.example.net"},
+			},
+		},
+		{
+			name:     "zone not enclosing the question",
+			response: referral("www.example.org", "example.com", "ns.evil.example", "203.0.113.66"),
+			zone:     "com",
+			lookup:   "www.example.com",
+		},
+		{
+			name:     "upward referral",
+			response: referral("www.example.com", "com", "ns.evil.com", "203.0.113.66"),
+			zone:     "example.com",
+			lookup:   "www.google.com",
+		},
+		{
+			name:     "referral to the same zone",
+			response: referral("www.example.com", "example.com", "ns.evil.example.com", "203.0.113.66"),
+			zone:     "example.com",
+			lookup:   "www.example.com",
+		},
+		{
+			name:     "sideways referral",
+			response: referral("www.example.com", "example.com", "ns.evil.example.com", "203.0.113.66"),
+			zone:     "org",
+			lookup:   "www.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, _ := newTestCache(10)
+			cache.storeResponse(tt.response, tt.zone)
+			if got, _ := cache.delegation(tt.lookup); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_storeResponse_outOfZoneAlias(t *testing.T) {
+	cache, _ := newTestCache(10)
+	alias := testRecord("www.example.com", &CNAME{Target: "www.bank.org"})
+	cache.storeResponse(Message{
+		Questions: []Question{{Name: []byte("www.example.com"), Type: TypeA, Class: ClassIn}},
+		Answers:   []Record{alias, testRecord("www.bank.org", &A{Addr: netip.MustParseAddr("203.0.113.66")})},
+	}, "example.com")
+	if got, ok := cache.Get("www.example.com", TypeCNAME, ClassIn); !ok || !reflect.DeepEqual(got, []Record{alias}) {
+		t.Errorf("expected the alias inside the zone to be cached, got %v", got)
+	}
+	if got, ok := cache.Get("www.bank.org", TypeA, ClassIn); ok {
+		t.Errorf("expected the answer outside the zone not to be cached, got %v", got)
+	}
+}
+
+func TestResolver_Lookup_cache(t *testing.T) {
+	resolver := fakeHierarchy()
+	resolver.Cache, _ = newTestCache(100)
+	counts := countQueries(resolver)
+
+	if _, err := resolver.Lookup(context.Background(), "www.example.com", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if counts["192.0.2.1"] == 0 || counts["192.0.2.2"] == 0 {
+		t.Fatalf("expected the first lookup to start at the root, got %v", counts)
+	}
+
+	for server := range counts {
+		delete(counts, server)
+	}
+	if _, err := resolver.Lookup(context.Background(), "www.example.com", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("expected a cached answer without any queries, got %v", counts)
+	}
+
+	records, err := resolver.Lookup(context.Background(), "alias.example.com", "TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Errorf("expected the alias and its TXT record, got %v", records)
+	}
+	if want := map[string]int{"192.0.2.3": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("expected a single query to the cached name server of example.com, got %v", counts)
+	}
+}
+
+func TestResolver_Lookup_negativeCache(t *testing.T) {
+	resolver := fakeHierarchy()
+	cache, clock := newTestCache(100)
+	resolver.Cache = cache
+	counts := countQueries(resolver)
+	authoritative := func() int {
+		defer delete(counts, "192.0.2.3")
+		return counts["192.0.2.3"]
+	}
+
+	tests := []struct {
+		name       string
+		domainName string
+		recordType string
+		wantErr    error
+		wantSent   int
+	}{
+		{name: "NXDOMAIN", domainName: "missing.example.com", recordType: "A", wantErr: ErrNXDomain, wantSent: 1},
+		{name: "cached NXDOMAIN", domainName: "MISSING.example.com.", recordType: "A", wantErr: ErrNXDomain},
+		{name: "NXDOMAIN for another type", domainName: "missing.example.com", recordType: "MX", wantErr: ErrNXDomain},
+		{name: "NODATA", domainName: "www.example.com", recordType: "MX", wantErr: ErrNoData, wantSent: 1},
+		{name: "cached NODATA", domainName: "www.example.com", recordType: "MX", wantErr: ErrNoData},
+		{name: "NODATA for another type", domainName: "www.example.com", recordType: "A", wantSent: 1},
+		{name: "NODATA through an alias", domainName: "alias.example.com", recordType: "MX", wantErr: ErrNoData, wantSent: 1},
+		{name: "cached NODATA through an alias", domainName: "alias.example.com", recordType: "MX", wantErr: ErrNoData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resolver.Lookup(context.Background(), tt.domainName, tt.recordType)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if sent := authoritative(); sent != tt.wantSent {
+				t.Errorf("expected %d queries to the authoritative server, got %d", tt.wantSent, sent)
+			}
+		})
+	}
+
+	clock.advance(59 * time.Second)
+	_, err := resolver.Lookup(context.Background(), "missing.example.com", "A")
+	var responseErr *ResponseError
+	if !errors.As(err, &responseErr) || responseErr.SOA == nil || responseErr.SOA.TTL != 1 {
+		t.Errorf("expected the cached SOA record with 1 second left, got %v", err)
+	}
+	clock.advance(time.Second)
+	if _, err := resolver.Lookup(context.Background(), "missing.example.com", "A"); !errors.Is(err, ErrNXDomain) {
+		t.Fatalf("expected error %v, got %v", ErrNXDomain, err)
+	}
+	if sent := authoritative(); sent != 1 {
+		t.Errorf("expected the negative answer to expire after the SOA MINIMUM, got %d queries", sent)
+	}
+}
+
+func TestCache_answer_prefetch(t *testing.T) {
+	cache, clock := newTestCache(100)
+	cache.Put([]Record{
+		testRecord("alias.example.com", &CNAME{Target: "www.example.com"}),
+		testRecord("www.example.com", &A{Addr: netip.MustParseAddr("203.0.113.1")}),
+	})
+
+	tests := []struct {
+		name       string
+		domainName string
+		advance    time.Duration
+		// gets is the number of times the RRset is read with Get first, which must not count.
+		gets         int
+		wantPrefetch bool
+	}{
+		{name: "first use", domainName: "www.example.com"},
+		{name: "fresh", domainName: "www.example.com", advance: 200 * time.Second},
+		{name: "about to expire", domainName: "www.example.com", advance: 80 * time.Second, gets: 2, wantPrefetch: true},
+		{name: "already prefetched", domainName: "www.example.com"},
+		{name: "alias used once", domainName: "alias.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.advance(tt.advance)
+			for i := 0; i < tt.gets; i++ {
+				if _, ok := cache.Get(tt.domainName, TypeA, ClassIn); !ok {
+					t.Fatalf("expected %s to be cached", tt.domainName)
+				}
+			}
+			_, answers, prefetch, err := cache.answer(tt.domainName, TypeA, false)
+			if err != nil || len(answers) != 1 {
+				t.Fatalf("expected a cached answer, got %v, %v", answers, err)
+			}
+			if prefetch != tt.wantPrefetch {
+				t.Errorf("expected prefetch %v, got %v", tt.wantPrefetch, prefetch)
+			}
+		})
+	}
+}
+
+func TestResolver_Lookup_serveStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxStale time.Duration
+		advance  time.Duration
+		wantErr  error
+	}{
+		{name: "fresh", maxStale: time.Hour, advance: 299 * time.Second},
+		{name: "stale", maxStale: time.Hour, advance: 301 * time.Second},
+		{name: "serve stale disabled", advance: 301 * time.Second, wantErr: ErrServersFailed},
+		{name: "too stale", maxStale: time.Hour, advance: time.Hour + 301*time.Second, wantErr: ErrServersFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := fakeHierarchy()
+			resolver.Retries = 0
+			cache, clock := newTestCache(100)
+			cache.MaxStale = tt.maxStale
+			resolver.Cache = cache
+			if _, err := resolver.Lookup(context.Background(), "www.example.com", "A"); err != nil {
+				t.Fatal(err)
+			}
+
+			// The authoritative server of example.com and example.net goes down.
+			delete(resolver.Transport.(*MemoryTransport).Servers, netip.AddrPortFrom(netip.MustParseAddr("192.0.2.3"), DefaultPort))
+			clock.advance(tt.advance)
+			records, err := resolver.Lookup(context.Background(), "www.example.com", "A")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			wantTTL := int32(300 - tt.advance/time.Second)
+			if tt.advance >= 300*time.Second {
+				wantTTL = staleTTL
+			}
+			if len(records) != 2 || records[0].TTL != wantTTL {
+				t.Errorf("expected both addresses with a TTL of %d, got %v", wantTTL, records)
+			}
+		})
+	}
+}
+
+func TestResolver_Lookup_prefetch(t *testing.T) {
+	resolver := fakeHierarchy()
+	resolver.Prefetch = true
+	cache, clock := newTestCache(100)
+	resolver.Cache = cache
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.Lookup(context.Background(), "www.example.com", "A"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.advance(290 * time.Second)
+	records, err := resolver.Lookup(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].TTL != 10 {
+		t.Errorf("expected the cached answer with 10 seconds left, got %v", records)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if records, ok := cache.Get("www.example.com", TypeA, ClassIn); ok && records[0].TTL == 300 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the answer to be prefetched before it expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolver_Lookup_outOfZone(t *testing.T) {
+	resolver := fakeHierarchy()
+	resolver.Cache, _ = newTestCache(100)
+	transport := resolver.Transport.(*MemoryTransport)
+	authoritative := netip.AddrPortFrom(netip.MustParseAddr("192.0.2.3"), DefaultPort)
+	handler := transport.Servers[authoritative]
+	evil := netip.MustParseAddr("203.0.113.66")
+	// The name server of example.com tries to answer for, and take over, names outside its zone.
+	transport.Servers[authoritative] = func(ctx context.Context, query Message) (Message, error) {
+		response, err := handler(ctx, query)
+		switch string(query.Questions[0].Name) {
+		case "poison.example.com":
+			response.SetRcode(RcodeSuccess)
+			response.Authorities = nil
+			response.Answers = []Record{
+				testRecord("poison.example.com", &CNAME{Target: "host.example.net"}),
+				testRecord("host.example.net", &AAAA{Addr: netip.MustParseAddr("2001:db8::666")}),
+			}
+		case "hijack.example.com":
+			response.SetRcode(RcodeSuccess)
+			response.Header.SetAA(false)
+			response.Authorities = []Record{testRecord("com", &NS{Host: "ns.evil.com"})}
+			response.Additionals = []Record{testRecord("ns.evil.com", &A{Addr: evil})}
+		}
+		return response, err
+	}
+
+	records, err := resolver.Lookup(context.Background(), "poison.example.com", "AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("2001:db8::1"); len(records) != 2 || recordAddr(records[1]) != want {
+		t.Errorf("expected the target of the alias to be resolved to %v, got %v", want, records)
+	}
+	if cached, _ := resolver.Cache.Get("host.example.net", TypeAAAA, ClassIn); len(cached) != 1 || recordAddr(cached[0]) != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("expected only the genuine address to be cached, got %v", cached)
+	}
+
+	_, err = resolver.Lookup(context.Background(), "hijack.example.com", "A")
+	if !errors.Is(err, ErrServersFailed) || !errors.Is(err, ErrBadReferral) {
+		t.Errorf("expected error %v and %v, got %v", ErrServersFailed, ErrBadReferral, err)
+	}
+	servers, _ := resolver.Cache.delegation("www.google.com")
+	for _, server := range servers {
+		if server.name == "ns.evil.com" || server.addr == evil {
+			t.Errorf("expected the referral not to be cached, got %v", servers)
+		}
+	}
+}
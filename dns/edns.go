@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TypeOPT is the record type of the EDNS(0) OPT pseudo-record as defined in [RFC 6891 section 6.1.1].
+//
+// [RFC 6891 section 6.1.1]: https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.1
+const TypeOPT = 41
+
+const (
+	// DefaultUDPSize is the UDP payload size advertised in queries, as recommended by DNS Flag Day 2020
+	// to avoid IP fragmentation.
+	DefaultUDPSize = 1232
+	// minUDPSize is the UDP payload size every DNS implementation supports.
+	// Smaller advertised sizes are treated as this size, as described in RFC 6891 section 6.2.3.
+	minUDPSize = 512
+)
+
+// EDNSFlagDO is the DNSSEC OK bit of EDNS.Flags, as defined in [RFC 3225 section 3].
+//
+// [RFC 3225 section 3]: https://datatracker.ietf.org/doc/html/rfc3225#section-3
+const EDNSFlagDO = 1 << 15
+
+// EDNS holds the contents of the OPT pseudo-record of a message, which extends the DNS protocol
+// as defined in [RFC 6891].
+//
+// [RFC 6891]: https://datatracker.ietf.org/doc/html/rfc6891
+type EDNS struct {
+	// UDPSize is the largest UDP payload that the sender can reassemble and deliver.
+	UDPSize uint16
+	// ExtendedRcode holds the upper 8 bits of the 12 bit response code,
+	// whose lower 4 bits are in the message header.
+	ExtendedRcode uint8
+	// Version is the version of EDNS implemented by the sender. Only version 0 is defined.
+	Version uint8
+	// Flags holds the EDNS flags, such as EDNSFlagDO.
+	Flags uint16
+	// Options contains the options carried in the data of the OPT record.
+	Options []EDNSOption
+}
+
+// DO reports whether the sender is able to accept DNSSEC security records.
+func (e *EDNS) DO() bool {
+	return e.Flags&EDNSFlagDO != 0
+}
+
+func (e *EDNS) String() string {
+	flags := ""
+	if e.DO() {
+		flags = "do"
+	}
+	return fmt.Sprintf("EDNS{version: %d, flags: %s, udp: %d, options: %v}", e.Version, flags, e.UDPSize, e.Options)
+}
+
+// record returns the OPT pseudo-record that encodes the EDNS information.
+// The UDP payload size is carried in the class field, and the extended response code,
+// version and flags in the TTL field.
+func (e *EDNS) record() Record {
+	return Record{
+		Name:  []byte("."),
+		Type:  TypeOPT,
+		Class: e.UDPSize,
+		TTL:   int32(uint32(e.ExtendedRcode)<<24 | uint32(e.Version)<<16 | uint32(e.Flags)),
+		Data:  &OPT{Options: e.Options},
+	}
+}
+
+// ednsFromRecord returns the EDNS information held by an OPT pseudo-record.
+func ednsFromRecord(record Record) *EDNS {
+	ttl := uint32(record.TTL)
+	edns := &EDNS{
+		UDPSize:       record.Class,
+		ExtendedRcode: uint8(ttl >> 24),
+		Version:       uint8(ttl >> 16),
+		Flags:         uint16(ttl),
+	}
+	if opt, ok := record.Data.(*OPT); ok {
+		edns.Options = opt.Options
+	}
+	return edns
+}
+
+// EDNSOption is a single option in the data of an OPT pseudo-record.
+type EDNSOption struct {
+	// Code identifies the option, such as 10 for a DNS cookie.
+	Code uint16
+	// Data is the value of the option.
+	Data []byte
+}
+
+func (o EDNSOption) String() string {
+	return fmt.Sprintf("%d:%s", o.Code, hex.EncodeToString(o.Data))
+}
+
+// OPT is the data of an OPT pseudo-record, a list of EDNS options.
+// Messages hold the OPT record in their EDNS field instead of in their additional section.
+type OPT struct {
+	Options []EDNSOption
+}
+
+func (opt *OPT) unpack(reader *bytes.Reader, length uint16) error {
+	end := offset(reader) + int64(length)
+	opt.Options = nil
+	for offset(reader) < end {
+		start := offset(reader)
+		var option EDNSOption
+		var optionLength uint16
+		if err := readBigEndian(reader, &option.Code, &optionLength); err != nil {
+			return err
+		}
+		if offset(reader)+int64(optionLength) > end {
+			return &ParseError{Offset: start, Err: ErrBadRData}
+		}
+		option.Data = make([]byte, optionLength)
+		_, _ = reader.Read(option.Data)
+		opt.Options = append(opt.Options, option)
+	}
+	return nil
+}
+
+func (opt *OPT) pack(p *packer) error {
+	for _, option := range opt.Options {
+		if len(option.Data) > 0xffff {
+			return ErrBadRData
+		}
+		p.uint16(option.Code)
+		p.uint16(uint16(len(option.Data)))
+		p.bytes(option.Data)
+	}
+	return nil
+}
+
+func (opt *OPT) String() string {
+	options := make([]string, len(opt.Options))
+	for i, option := range opt.Options {
+		options[i] = option.String()
+	}
+	return strings.Join(options, " ")
+}
+
+// SetEDNS adds EDNS information to the message, advertising the UDP payload size that
+// the sender can receive and whether it wants DNSSEC records to be included (the DO bit).
+// Any EDNS information already present is replaced.
+func (p *Message) SetEDNS(udpSize uint16, do bool) {
+	p.EDNS = &EDNS{UDPSize: udpSize}
+	if do {
+		p.EDNS.Flags |= EDNSFlagDO
+	}
+}
+
+// Rcode returns the full response code of the message, combining the four bits in the
+// header with the extended response code of the EDNS information, if present.
+func (p Message) Rcode() Rcode {
+	rcode := p.Header.Rcode()
+	if p.EDNS != nil {
+		rcode |= Rcode(p.EDNS.ExtendedRcode) << 4
+	}
+	return rcode
+}
+
+// SetRcode sets the response code of the message. The upper bits of response codes
+// above 15 are stored in the EDNS information, which is added if not already present.
+func (p *Message) SetRcode(rcode Rcode) {
+	p.Header.SetRcode(rcode)
+	if rcode > 0b1111 && p.EDNS == nil {
+		p.SetEDNS(DefaultUDPSize, false)
+	}
+	if p.EDNS != nil {
+		p.EDNS.ExtendedRcode = uint8(rcode >> 4)
+	}
+}
+
+// MaxUDPSize returns the largest UDP response the sender of the message can receive.
+func (p Message) MaxUDPSize() int {
+	if p.EDNS == nil || p.EDNS.UDPSize < minUDPSize {
+		return minUDPSize
+	}
+	return int(p.EDNS.UDPSize)
+}
@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestMessage_SetEDNS(t *testing.T) {
+	query := NewQuery(0x8298, "example.com", TypeA)
+	query.SetEDNS(4096, true)
+	got, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x82\x98\x00\x00\x00\x01\x00\x00\x00\x00\x00\x01\aexample\x03com\x00\x00\x01\x00\x01" +
+		"\x00\x00\x29\x10\x00\x00\x00\x80\x00\x00\x00"
+	if string(got) != want {
+		t.Errorf("expected %q but got %q", want, got)
+	}
+}
+
+func TestParseMessage_EDNS(t *testing.T) {
+	glue := Record{Name: []byte("ns1.example.com"), Type: TypeA, Class: ClassIn, TTL: 60, Data: &A{Addr: netip.MustParseAddr("192.0.2.53")}}
+	edns := &EDNS{
+		UDPSize:       1232,
+		ExtendedRcode: 1,
+		Version:       0,
+		Flags:         EDNSFlagDO,
+		Options:       []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}, {Code: 12, Data: []byte{}}},
+	}
+	message := Message{
+		Header:      Header{ID: 1, Flags: 0x8180},
+		Questions:   []Question{{Name: []byte("example.com"), Type: TypeA, Class: ClassIn}},
+		Additionals: []Record{glue},
+		EDNS:        edns,
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMessage(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Additionals, []Record{glue}) {
+		t.Errorf("expected the OPT record to be removed from the additionals, got %v", parsed.Additionals)
+	}
+	if !reflect.DeepEqual(parsed.EDNS, edns) {
+		t.Errorf("expected %v, got %v", edns, parsed.EDNS)
+	}
+	if !parsed.EDNS.DO() {
+		t.Error("expected the DO bit to be set")
+	}
+	if parsed.Rcode() != RcodeBadVers {
+		t.Errorf("expected rcode %s, got %s", RcodeBadVers, parsed.Rcode())
+	}
+}
+
+func TestParseMessage_badOPT(t *testing.T) {
+	tests := []struct {
+		name        string
+		count       string
+		additionals string
+	}{
+		{
+			name:        "two OPT records",
+			count:       "\x02",
+			additionals: "\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x00" + "\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x00",
+		},
+		{
+			name:        "OPT record not owned by the root",
+			count:       "\x01",
+			additionals: "\x03com\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "\x00\x01\x81\x80\x00\x00\x00\x00\x00\x00\x00" + tt.count + tt.additionals
+			_, err := ParseMessage([]byte(data))
+			if !errors.Is(err, ErrBadOPT) {
+				t.Errorf("expected error %v, got %v", ErrBadOPT, err)
+			}
+		})
+	}
+}
+
+func TestMessage_SetRcode(t *testing.T) {
+	message := Message{}
+	message.SetRcode(RcodeBadVers)
+	if message.EDNS == nil {
+		t.Fatal("expected EDNS to be added for an extended rcode")
+	}
+	if message.Header.Rcode() != RcodeSuccess || message.EDNS.ExtendedRcode != 1 {
+		t.Errorf("expected rcode 16 to be split into 0 and 1, got %d and %d", message.Header.Rcode(), message.EDNS.ExtendedRcode)
+	}
+	if message.Rcode() != RcodeBadVers {
+		t.Errorf("expected rcode %s, got %s", RcodeBadVers, message.Rcode())
+	}
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTruncated is returned when a message ends before all of its fields have been read.
+	ErrTruncated = errors.New("dns: message truncated")
+	// ErrBadLabel is returned when a domain name contains a label that cannot be decoded.
+	ErrBadLabel = errors.New("dns: bad label")
+	// ErrBadPointer is returned when a compression pointer does not point to an earlier part of the message.
+	ErrBadPointer = errors.New("dns: bad compression pointer")
+	// ErrPointerLoop is returned when following compression pointers would revisit labels already read.
+	ErrPointerLoop = errors.New("dns: compression pointer loop")
+	// ErrNameTooLong is returned when a domain name is longer than 255 bytes.
+	ErrNameTooLong = errors.New("dns: domain name too long")
+	// ErrBadRData is returned when the data of a record is not valid for its type.
+	ErrBadRData = errors.New("dns: bad record data")
+	// ErrBadOPT is returned when a message holds more than one OPT pseudo-record, or one not owned by the root.
+	ErrBadOPT = errors.New("dns: bad OPT record")
+	// ErrTooManyEntries is returned when a section holds more entries than its 16-bit count allows.
+	ErrTooManyEntries = errors.New("dns: too many entries in section")
+	// ErrMessageTooLarge is returned when a message is too large to be sent over TCP.
+	ErrMessageTooLarge = errors.New("dns: message too large")
+	// ErrMismatchedResponse is returned when a response does not match the ID or question of its query.
+	ErrMismatchedResponse = errors.New("dns: response does not match query")
+	// ErrTrailingData is returned when bytes remain after every section of a message has been read.
+	ErrTrailingData = errors.New("dns: trailing data after message")
+)
+
+var (
+	// ErrFormErr is returned when a name server was unable to interpret a query.
+	ErrFormErr = errors.New("dns: format error")
+	// ErrServFail is returned when a name server was unable to process a query due to a problem with the name server.
+	ErrServFail = errors.New("dns: server failure")
+	// ErrNXDomain is returned when the domain name referenced in a query does not exist.
+	ErrNXDomain = errors.New("dns: no such domain")
+	// ErrNotImp is returned when a name server does not support the requested kind of query.
+	ErrNotImp = errors.New("dns: not implemented")
+	// ErrRefused is returned when a name server refuses to perform a query for policy reasons.
+	ErrRefused = errors.New("dns: query refused")
+	// ErrNoData is returned when the domain name exists but has no records of the requested type.
+	ErrNoData = errors.New("dns: no records of the requested type")
+	// ErrBadVers is returned when a name server does not implement the EDNS version of a query.
+	ErrBadVers = errors.New("dns: unsupported EDNS version")
+	// ErrUnexpectedRcode is returned when a name server responds with any other response code.
+	ErrUnexpectedRcode = errors.New("dns: unexpected response code")
+)
+
+var (
+	// ErrUnknownType is returned when a query is made for a record type that is not in RecordTypes.
+	ErrUnknownType = errors.New("dns: unknown record type")
+	// ErrServersFailed is returned when none of the name servers for a zone could answer a query.
+	// The errors from each attempt are wrapped along with it.
+	ErrServersFailed = errors.New("dns: all name servers failed")
+	// ErrUnreachable is returned by a MemoryTransport for queries to servers it has no handler for.
+	ErrUnreachable = errors.New("dns: name server unreachable")
+	// ErrBadRootHints is returned when a root hints file cannot be parsed.
+	ErrBadRootHints = errors.New("dns: bad root hints")
+	// ErrNoRootServers is returned when root hints or a priming response hold no root server addresses.
+	ErrNoRootServers = errors.New("dns: no root server addresses")
+	// ErrCNAMELoop is returned when the aliases of a name form a loop, or a chain too long to follow.
+	ErrCNAMELoop = errors.New("dns: CNAME loop")
+	// ErrBudgetExceeded is returned when a resolution sends more queries, takes longer
+	// or nests more deeply than the Resolver allows.
+	ErrBudgetExceeded = errors.New("dns: resolution budget exceeded")
+	// ErrMaxDepth is returned along with ErrBudgetExceeded when resolving a name requires
+	// more nested name server lookups than the Resolver allows.
+	ErrMaxDepth = errors.New("dns: maximum resolution depth exceeded")
+	// ErrBadReferral is returned when a name server refers a query to a zone that is not below
+	// its own zone, or that does not enclose the queried name.
+	ErrBadReferral = errors.New("dns: referral outside the zone of the name server")
+)
+
+// rcodeErrors maps the response codes of failed queries to the errors describing them.
+var rcodeErrors = map[Rcode]error{
+	RcodeFormatError:    ErrFormErr,
+	RcodeServerFailure:  ErrServFail,
+	RcodeNameError:      ErrNXDomain,
+	RcodeNotImplemented: ErrNotImp,
+	RcodeRefused:        ErrRefused,
+	RcodeBadVers:        ErrBadVers,
+}
+
+// ResponseError describes a response that does not answer a query, either because of its
+// response code or because the name has no records of the requested type (NODATA).
+// Use errors.Is with ErrNXDomain, ErrServFail, ErrRefused, ErrNotImp, ErrFormErr or ErrNoData
+// to find out which kind of failure occurred.
+type ResponseError struct {
+	// Server is the address of the name server that sent the response.
+	Server string
+	// Name is the domain name that was queried.
+	Name string
+	// Type is the record type that was queried.
+	Type uint16
+	// Rcode is the response code of the response.
+	Rcode Rcode
+	// SOA is the SOA record from the authority section of the response, or nil if there was none.
+	SOA *Record
+	// Err is the error corresponding to the failure, such as ErrNXDomain.
+	Err error
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%v: %s %s (%s from %s)", e.Err, e.Name, TypeString(e.Type), e.Rcode, e.Server)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError describes a failure to parse a DNS message, along with the
+// byte offset into the message where parsing failed.
+type ParseError struct {
+	// Offset is the position in the message at which the error was detected.
+	Offset int64
+	// Err is the underlying error, such as ErrTruncated or ErrBadLabel.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// offset returns the current position of the reader from the start of the message.
+func offset(reader *bytes.Reader) int64 {
+	return reader.Size() - int64(reader.Len())
+}
+
+// readBigEndian reads each of the given values from the reader in network byte order.
+// A short read is reported as ErrTruncated at the offset of the value that could not be read.
+func readBigEndian(reader *bytes.Reader, data ...any) error {
+	for _, d := range data {
+		start := offset(reader)
+		if err := binary.Read(reader, binary.BigEndian, d); err != nil {
+			return &ParseError{Offset: start, Err: ErrTruncated}
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 )
 
 // Header implements a DNS message header as defined in [RFC 1035 section 4.1.1].
@@ -30,12 +31,18 @@ type Header struct {
 	//  - RA - a one bit field that is set or cleared in a response, and denotes whether recursive query support is
 	//    available in the name server.
 	//  - Z - a three bit field that is reserved for future use. Must be zero in all queries and responses.
+	//    [RFC 4035 section 3.2] has since assigned the lower two bits to the AD (authentic data)
+	//    and CD (checking disabled) flags.
 	//  - RCODE - a four bit field that is set as part of responses. The values are no error condition (0),
 	//    a format error (1) meaning the name server was unable to interpret the query, a server failure (2) meaning
 	//    the name server was unable to process the query due to a problem with the name server, a name error (3) meaning
 	//    that the domain name referenced in the query does not exist, not implemented (4) meaning the name server does
 	//    not support the requested kind of query, refused (5) meaning the name server refuses to perform the specified
 	//    operation for policy reasons, reserved for future use (6-15).
+	//
+	// Each field can be read and written with the accessor methods, such as RD and SetRD.
+	//
+	// [RFC 4035 section 3.2]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.2
 	Flags uint16
 	// NumQuestions represents QDCOUNT, an unsigned 16-bit integer specifying the
 	// number of entries in the question section.
@@ -51,17 +58,207 @@ type Header struct {
 	NumAdditionals uint16
 }
 
+// Bit masks for the fields packed into Header.Flags.
+const (
+	flagQR     = 1 << 15
+	flagOpcode = 0b1111 << 11
+	flagAA     = 1 << 10
+	flagTC     = 1 << 9
+	flagRD     = 1 << 8
+	flagRA     = 1 << 7
+	flagAD     = 1 << 5
+	flagCD     = 1 << 4
+	flagRcode  = 0b1111
+)
+
+// Opcode specifies the kind of query in a message.
+type Opcode uint8
+
+// Opcodes as defined in [RFC 1035 section 4.1.1], [RFC 1996] and [RFC 2136].
+//
+// [RFC 1035 section 4.1.1]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.1
+// [RFC 1996]: https://datatracker.ietf.org/doc/html/rfc1996
+// [RFC 2136]: https://datatracker.ietf.org/doc/html/rfc2136
+const (
+	OpcodeQuery  Opcode = 0
+	OpcodeIQuery Opcode = 1
+	OpcodeStatus Opcode = 2
+	OpcodeNotify Opcode = 4
+	OpcodeUpdate Opcode = 5
+)
+
+var opcodeNames = map[Opcode]string{
+	OpcodeQuery:  "QUERY",
+	OpcodeIQuery: "IQUERY",
+	OpcodeStatus: "STATUS",
+	OpcodeNotify: "NOTIFY",
+	OpcodeUpdate: "UPDATE",
+}
+
+func (o Opcode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("OPCODE%d", uint8(o))
+}
+
+// Rcode is the response code set by a name server in its response.
+type Rcode uint16
+
+// Response codes as defined in [RFC 1035 section 4.1.1].
+//
+// [RFC 1035 section 4.1.1]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.1
+const (
+	// RcodeSuccess means there was no error condition.
+	RcodeSuccess Rcode = 0
+	// RcodeFormatError means the name server was unable to interpret the query.
+	RcodeFormatError Rcode = 1
+	// RcodeServerFailure means the name server was unable to process the query due to a problem with the name server.
+	RcodeServerFailure Rcode = 2
+	// RcodeNameError means the domain name referenced in the query does not exist.
+	RcodeNameError Rcode = 3
+	// RcodeNotImplemented means the name server does not support the requested kind of query.
+	RcodeNotImplemented Rcode = 4
+	// RcodeRefused means the name server refuses to perform the specified operation for policy reasons.
+	RcodeRefused Rcode = 5
+	// RcodeBadVers means the name server does not implement the EDNS version of the query,
+	// as defined in RFC 6891 section 9. It can only be carried in messages using EDNS.
+	RcodeBadVers Rcode = 16
+)
+
+var rcodeNames = map[Rcode]string{
+	RcodeSuccess:        "NOERROR",
+	RcodeFormatError:    "FORMERR",
+	RcodeServerFailure:  "SERVFAIL",
+	RcodeNameError:      "NXDOMAIN",
+	RcodeNotImplemented: "NOTIMP",
+	RcodeRefused:        "REFUSED",
+	RcodeBadVers:        "BADVERS",
+}
+
+func (r Rcode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", uint16(r))
+}
+
+// QR reports whether the message is a response.
+func (h Header) QR() bool { return h.Flags&flagQR != 0 }
+
+// SetQR marks the message as a response (true) or a query (false).
+func (h *Header) SetQR(v bool) { h.setFlag(flagQR, v) }
+
+// Opcode returns the kind of query in the message.
+func (h Header) Opcode() Opcode { return Opcode((h.Flags & flagOpcode) >> 11) }
+
+// SetOpcode sets the kind of query in the message. Only the lower four bits of the opcode are kept.
+func (h *Header) SetOpcode(o Opcode) {
+	h.Flags = h.Flags&^flagOpcode | uint16(o)<<11&flagOpcode
+}
+
+// AA reports whether the responding name server is an authority for the domain name in the question.
+func (h Header) AA() bool { return h.Flags&flagAA != 0 }
+
+// SetAA sets the authoritative answer bit.
+func (h *Header) SetAA(v bool) { h.setFlag(flagAA, v) }
+
+// TC reports whether the message was truncated.
+func (h Header) TC() bool { return h.Flags&flagTC != 0 }
+
+// SetTC sets the truncation bit.
+func (h *Header) SetTC(v bool) { h.setFlag(flagTC, v) }
+
+// RD reports whether recursion is desired.
+func (h Header) RD() bool { return h.Flags&flagRD != 0 }
+
+// SetRD sets the recursion desired bit.
+func (h *Header) SetRD(v bool) { h.setFlag(flagRD, v) }
+
+// RA reports whether the name server supports recursive queries.
+func (h Header) RA() bool { return h.Flags&flagRA != 0 }
+
+// SetRA sets the recursion available bit.
+func (h *Header) SetRA(v bool) { h.setFlag(flagRA, v) }
+
+// AD reports whether the name server considers all the data in the response authentic,
+// as defined in [RFC 4035 section 3.2.3].
+//
+// [RFC 4035 section 3.2.3]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.2.3
+func (h Header) AD() bool { return h.Flags&flagAD != 0 }
+
+// SetAD sets the authentic data bit.
+func (h *Header) SetAD(v bool) { h.setFlag(flagAD, v) }
+
+// CD reports whether the requester disabled signature validation,
+// as defined in [RFC 4035 section 3.2.2].
+//
+// [RFC 4035 section 3.2.2]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.2.2
+func (h Header) CD() bool { return h.Flags&flagCD != 0 }
+
+// SetCD sets the checking disabled bit.
+func (h *Header) SetCD(v bool) { h.setFlag(flagCD, v) }
+
+// Rcode returns the response code of the message.
+func (h Header) Rcode() Rcode { return Rcode(h.Flags & flagRcode) }
+
+// SetRcode sets the response code of the message. Only the lower four bits of the code are kept.
+func (h *Header) SetRcode(r Rcode) {
+	h.Flags = h.Flags&^flagRcode | uint16(r)&flagRcode
+}
+
+func (h *Header) setFlag(flag uint16, v bool) {
+	if v {
+		h.Flags |= flag
+	} else {
+		h.Flags &^= flag
+	}
+}
+
+// flagsString formats the flags in the style of dig, for example "qr rd ra; status: NOERROR".
+// The opcode is only included when the message is not a standard query.
+func (h Header) flagsString() string {
+	var names []string
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{
+		{h.QR(), "qr"},
+		{h.AA(), "aa"},
+		{h.TC(), "tc"},
+		{h.RD(), "rd"},
+		{h.RA(), "ra"},
+		{h.AD(), "ad"},
+		{h.CD(), "cd"},
+	} {
+		if flag.set {
+			names = append(names, flag.name)
+		}
+	}
+
+	var parts []string
+	if len(names) > 0 {
+		parts = append(parts, strings.Join(names, " "))
+	}
+	if h.Opcode() != OpcodeQuery {
+		parts = append(parts, fmt.Sprintf("opcode: %s", h.Opcode()))
+	}
+	parts = append(parts, fmt.Sprintf("status: %s", h.Rcode()))
+	return strings.Join(parts, "; ")
+}
+
 // ParseHeader parses a given bytes reader into a Header.
-func ParseHeader(reader *bytes.Reader) Header {
+func ParseHeader(reader *bytes.Reader) (Header, error) {
 	h := Header{}
-	binary.Read(reader, binary.BigEndian, &h.ID)
-	binary.Read(reader, binary.BigEndian, &h.Flags)
-	binary.Read(reader, binary.BigEndian, &h.NumQuestions)
-	binary.Read(reader, binary.BigEndian, &h.NumAnswers)
-	binary.Read(reader, binary.BigEndian, &h.NumAuthorities)
-	binary.Read(reader, binary.BigEndian, &h.NumAdditionals)
-
-	return h
+	err := readBigEndian(reader,
+		&h.ID,
+		&h.Flags,
+		&h.NumQuestions,
+		&h.NumAnswers,
+		&h.NumAuthorities,
+		&h.NumAdditionals,
+	)
+	return h, err
 }
 
 // ToBytes encodes a Header as bytes.
@@ -81,14 +278,14 @@ func (h Header) String() string {
 	return fmt.Sprintf(
 		`Header{
     ID: %d,
-    Flags: %d,
+    Flags: %s,
     NumQuestions: %d,
     NumAnswers: %d,
     NumAuthorities: %d,
     NumAdditionals: %d
   }`,
 		h.ID,
-		h.Flags,
+		h.flagsString(),
 		h.NumQuestions,
 		h.NumAnswers,
 		h.NumAuthorities,
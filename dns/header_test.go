@@ -2,6 +2,7 @@ package dns
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -38,9 +39,10 @@ func TestDNSHeader_toBytes(t *testing.T) {
 
 func Test_parseHeader(t *testing.T) {
 	tests := []struct {
-		name   string
-		header *bytes.Reader
-		want   Header
+		name    string
+		header  *bytes.Reader
+		want    Header
+		wantErr error
 	}{
 		{
 			name:   "basic",
@@ -54,10 +56,20 @@ func Test_parseHeader(t *testing.T) {
 				NumAdditionals: 0,
 			},
 		},
+		{
+			name:    "truncated",
+			header:  bytes.NewReader([]byte("`V\x81\x80\x00\x01\x00")),
+			want:    Header{ID: 24662, Flags: 33152, NumQuestions: 1},
+			wantErr: ErrTruncated,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := ParseHeader(tt.header); !reflect.DeepEqual(got, tt.want) {
+			got, err := ParseHeader(tt.header)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("expected %q, got %q", tt.want, got)
 			}
 		})
@@ -78,12 +90,36 @@ func TestHeader_String(t *testing.T) {
 		fields fields
 		want   string
 	}{
+		{
+			name:   "response",
+			fields: fields{ID: 24662, Flags: 0x8183, NumQuestions: 1},
+			want: `Header{
+    ID: 24662,
+    Flags: qr rd ra; status: NXDOMAIN,
+    NumQuestions: 1,
+    NumAnswers: 0,
+    NumAuthorities: 0,
+    NumAdditionals: 0
+  }`,
+		},
+		{
+			name:   "notify",
+			fields: fields{Flags: 0x2400},
+			want: `Header{
+    ID: 0,
+    Flags: aa; opcode: NOTIFY; status: NOERROR,
+    NumQuestions: 0,
+    NumAnswers: 0,
+    NumAuthorities: 0,
+    NumAdditionals: 0
+  }`,
+		},
 		{
 			name:   "empty header",
 			fields: fields{},
 			want: `Header{
     ID: 0,
-    Flags: 0,
+    Flags: status: NOERROR,
     NumQuestions: 0,
     NumAnswers: 0,
     NumAuthorities: 0,
@@ -107,3 +143,55 @@ func TestHeader_String(t *testing.T) {
 		})
 	}
 }
+
+func TestHeader_flags(t *testing.T) {
+	h := Header{}
+	h.SetQR(true)
+	h.SetOpcode(OpcodeStatus)
+	h.SetAA(true)
+	h.SetTC(true)
+	h.SetRD(true)
+	h.SetRA(true)
+	h.SetAD(true)
+	h.SetCD(true)
+	h.SetRcode(RcodeRefused)
+	if h.Flags != 0b1_0010_1111_0_1_1_0101 {
+		t.Errorf("expected flags %016b, got %016b", 0b1_0010_1111_0_1_1_0101, h.Flags)
+	}
+	if !h.QR() || h.Opcode() != OpcodeStatus || !h.AA() || !h.TC() || !h.RD() || !h.RA() || !h.AD() || !h.CD() ||
+		h.Rcode() != RcodeRefused {
+		t.Errorf("getters do not match the flags that were set: %s", h.flagsString())
+	}
+
+	h.SetQR(false)
+	h.SetOpcode(OpcodeQuery)
+	h.SetAA(false)
+	h.SetTC(false)
+	h.SetRD(false)
+	h.SetRA(false)
+	h.SetAD(false)
+	h.SetCD(false)
+	h.SetRcode(RcodeSuccess)
+	if h.Flags != 0 {
+		t.Errorf("expected flags to be cleared, got %016b", h.Flags)
+	}
+}
+
+func TestRcode_String(t *testing.T) {
+	tests := []struct {
+		rcode Rcode
+		want  string
+	}{
+		{RcodeSuccess, "NOERROR"},
+		{RcodeNameError, "NXDOMAIN"},
+		{RcodeServerFailure, "SERVFAIL"},
+		{Rcode(11), "RCODE11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.rcode.String(); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
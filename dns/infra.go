@@ -0,0 +1,223 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// unknownSRTT is the smoothed round-trip time assumed for a name server that has not been
+	// queried yet, which places it after servers known to respond quickly and before slow ones.
+	// Unbound uses the same value.
+	unknownSRTT = 376 * time.Millisecond
+	// minBackoff is how long a name server is avoided after it first fails to respond.
+	// The backoff doubles with each further failure in a row, up to maxBackoff.
+	minBackoff = time.Second
+	maxBackoff = 2 * time.Minute
+	// lameTTL is how long a name server is avoided for a zone after refusing or failing to answer
+	// a query for it.
+	lameTTL = 15 * time.Minute
+	// infraTTL is how long the performance of a name server is remembered after it was last queried.
+	infraTTL = 15 * time.Minute
+	// maxInfraServers is the number of name servers whose performance is remembered.
+	maxInfraServers = 10000
+	// probeOdds is the inverse of the probability that a query is sent to a slower name server
+	// rather than to the fastest one, so that servers whose performance has improved are noticed.
+	probeOdds = 20
+)
+
+// infraCache records how each name server has performed, so that the fastest healthy name servers
+// of a delegation are queried first, as done by BIND and Unbound. Name servers that stop responding
+// are backed off exponentially, and those that refuse or fail to answer are treated as lame for the
+// zone they were queried for, as a server may well serve some of its zones and not others.
+// It is safe for concurrent use, and its zero value is ready to use.
+type infraCache struct {
+	mu      sync.Mutex
+	servers map[netip.Addr]*serverInfo
+	// now returns the current time, and is replaced in tests.
+	now func() time.Time
+	// intn returns a random number in [0, n), and is replaced in tests.
+	intn func(n int) int
+}
+
+// serverInfo is the performance of a single name server.
+type serverInfo struct {
+	// srtt is the smoothed round-trip time of the server, as defined for TCP by [RFC 6298].
+	//
+	// [RFC 6298]: https://datatracker.ietf.org/doc/html/rfc6298
+	srtt time.Duration
+	// timeouts is the number of queries in a row that the server has not responded to.
+	timeouts     int
+	backoffUntil time.Time
+	// lameUntil is when the server stops being avoided for each zone it was lame for.
+	lameUntil map[string]time.Time
+	updated   time.Time
+}
+
+func (c *infraCache) clock() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+func (c *infraCache) random(n int) int {
+	if c.intn == nil {
+		return int(binary.BigEndian.Uint32(randomBytes(4)) % uint32(n))
+	}
+	return c.intn(n)
+}
+
+// lookup returns the performance recorded for the name server, or nil if it is unknown.
+// It must be called with c.mu held.
+func (c *infraCache) lookup(server netip.Addr, now time.Time) *serverInfo {
+	info, ok := c.servers[server]
+	if !ok {
+		return nil
+	}
+	if !now.Before(info.updated.Add(infraTTL)) {
+		delete(c.servers, server)
+		return nil
+	}
+	return info
+}
+
+// update returns the performance recorded for the name server, adding it if it is unknown.
+// It must be called with c.mu held.
+func (c *infraCache) update(server netip.Addr, now time.Time) *serverInfo {
+	if info := c.lookup(server, now); info != nil {
+		info.updated = now
+		return info
+	}
+	if c.servers == nil {
+		c.servers = map[netip.Addr]*serverInfo{}
+	}
+	if len(c.servers) >= maxInfraServers {
+		for addr, info := range c.servers {
+			if !now.Before(info.updated.Add(infraTTL)) {
+				delete(c.servers, addr)
+			}
+		}
+		for addr := range c.servers {
+			if len(c.servers) < maxInfraServers {
+				break
+			}
+			delete(c.servers, addr)
+		}
+	}
+	info := &serverInfo{updated: now}
+	c.servers[server] = info
+	return info
+}
+
+// responded records that the name server responded after the given round-trip time to a query
+// for the zone. A lame server, which refused or failed to answer, is avoided for the zone for lameTTL.
+func (c *infraCache) responded(server netip.Addr, zone string, rtt time.Duration, lame bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock()
+	info := c.update(server, now)
+	if info.srtt == 0 {
+		info.srtt = rtt
+	} else {
+		info.srtt += (rtt - info.srtt) / 8
+	}
+	info.timeouts = 0
+	info.backoffUntil = time.Time{}
+	delete(info.lameUntil, zone)
+	if lame {
+		for lameZone, until := range info.lameUntil {
+			if !now.Before(until) {
+				delete(info.lameUntil, lameZone)
+			}
+		}
+		if info.lameUntil == nil {
+			info.lameUntil = map[string]time.Time{}
+		}
+		info.lameUntil[zone] = now.Add(lameTTL)
+	}
+}
+
+// failed records that the name server did not respond after waiting for the given time,
+// and backs it off.
+func (c *infraCache) failed(server netip.Addr, waited time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock()
+	info := c.update(server, now)
+	if waited < unknownSRTT {
+		// A server that cannot be reached at all must not look faster than one that was never queried.
+		waited = unknownSRTT
+	}
+	if info.srtt == 0 {
+		info.srtt = waited
+	} else {
+		info.srtt += (waited - info.srtt) / 8
+	}
+	backoff := maxBackoff
+	if info.timeouts < 8 {
+		if b := minBackoff << info.timeouts; b < maxBackoff {
+			backoff = b
+		}
+	}
+	info.timeouts++
+	info.backoffUntil = now.Add(backoff)
+}
+
+// order returns the name servers of the zone in the order they should be queried: healthy servers
+// from the lowest to the highest smoothed round-trip time, then servers that are backed off or lame
+// for the zone.
+// Every so often, one of the slower healthy servers is moved to the front to probe it. Servers
+// without an address keep their relative order at the end, as they must be resolved first.
+func (c *infraCache) order(servers []nameserver, zone string) []nameserver {
+	type ranked struct {
+		server     nameserver
+		avoided    bool
+		srtt       time.Duration
+		unresolved bool
+	}
+	c.mu.Lock()
+	now := c.clock()
+	ranks := make([]ranked, len(servers))
+	for i, server := range servers {
+		ranks[i] = ranked{server: server, srtt: unknownSRTT, unresolved: !server.addr.IsValid()}
+		if info := c.lookup(server.addr, now); info != nil {
+			ranks[i].srtt = info.srtt
+			ranks[i].avoided = now.Before(info.backoffUntil) || now.Before(info.lameUntil[zone])
+		}
+	}
+	c.mu.Unlock()
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		a, b := ranks[i], ranks[j]
+		if a.unresolved != b.unresolved {
+			return b.unresolved
+		}
+		if a.unresolved {
+			return false
+		}
+		if a.avoided != b.avoided {
+			return b.avoided
+		}
+		return a.srtt < b.srtt
+	})
+	healthy := 0
+	for healthy < len(ranks) && !ranks[healthy].unresolved && !ranks[healthy].avoided {
+		healthy++
+	}
+	if healthy > 1 && c.random(probeOdds) == 0 {
+		probe := 1 + c.random(healthy-1)
+		probed := ranks[probe]
+		copy(ranks[1:probe+1], ranks[:probe])
+		ranks[0] = probed
+	}
+
+	ordered := make([]nameserver, len(ranks))
+	for i, rank := range ranks {
+		ordered[i] = rank.server
+	}
+	return ordered
+}
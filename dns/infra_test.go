@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestInfra returns an infrastructure cache whose clock is controlled by the test,
+// and which never probes slower servers.
+func newTestInfra() (*infraCache, *fakeClock) {
+	clock := &fakeClock{time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return &infraCache{now: clock.now, intn: func(n int) int { return n - 1 }}, clock
+}
+
+func TestInfraCache_order(t *testing.T) {
+	fast := nameserver{addr: netip.MustParseAddr("192.0.2.1")}
+	slow := nameserver{addr: netip.MustParseAddr("192.0.2.2")}
+	unknown := nameserver{addr: netip.MustParseAddr("192.0.2.3")}
+	down := nameserver{addr: netip.MustParseAddr("192.0.2.4")}
+	lame := nameserver{addr: netip.MustParseAddr("192.0.2.5")}
+	glueless := nameserver{name: "ns.example.net"}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		probe   bool
+		// zone is the zone the servers are ordered for, example.com unless set.
+		zone    string
+		servers []nameserver
+		want    []nameserver
+	}{
+		{
+			name:    "by round-trip time",
+			servers: []nameserver{slow, unknown, fast},
+			want:    []nameserver{fast, unknown, slow},
+		},
+		{
+			name:    "unhealthy servers last",
+			servers: []nameserver{lame, down, glueless, slow, fast},
+			want:    []nameserver{fast, slow, lame, down, glueless},
+		},
+		{
+			name:    "lame for another zone",
+			zone:    "example.net",
+			servers: []nameserver{slow, lame, fast},
+			want:    []nameserver{lame, fast, slow},
+		},
+		{
+			name:    "probe a slower server",
+			probe:   true,
+			servers: []nameserver{slow, unknown, fast, down},
+			want:    []nameserver{unknown, fast, slow, down},
+		},
+		{
+			name:    "backoff over",
+			advance: minBackoff,
+			servers: []nameserver{down, fast},
+			want:    []nameserver{fast, down},
+		},
+		{
+			name:    "forgotten",
+			advance: infraTTL,
+			servers: []nameserver{slow, unknown, lame, fast},
+			want:    []nameserver{slow, unknown, lame, fast},
+		},
+	}
+
+	infra, clock := newTestInfra()
+	infra.responded(fast.addr, "example.com", 10*time.Millisecond, false)
+	infra.responded(slow.addr, "example.com", time.Second, false)
+	infra.responded(lame.addr, "example.com", time.Millisecond, true)
+	infra.responded(lame.addr, "example.net", time.Millisecond, false)
+	infra.failed(down.addr, time.Millisecond)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.advance(tt.advance)
+			if tt.probe {
+				infra.intn = func(n int) int { return 0 }
+				defer func() { infra.intn = func(n int) int { return n - 1 } }()
+			}
+			zone := tt.zone
+			if zone == "" {
+				zone = "example.com"
+			}
+			if got := infra.order(tt.servers, zone); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestInfraCache_responded(t *testing.T) {
+	infra, _ := newTestInfra()
+	server := netip.MustParseAddr("192.0.2.1")
+	for _, rtt := range []time.Duration{100 * time.Millisecond, 180 * time.Millisecond} {
+		infra.responded(server, "example.com", rtt, false)
+	}
+	if srtt := infra.servers[server].srtt; srtt != 110*time.Millisecond {
+		t.Errorf("expected a smoothed round-trip time of 110ms, got %v", srtt)
+	}
+}
+
+func TestInfraCache_failed(t *testing.T) {
+	infra, clock := newTestInfra()
+	server := netip.MustParseAddr("192.0.2.1")
+	wantBackoff := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	for _, want := range wantBackoff {
+		infra.failed(server, time.Second)
+		if backoff := infra.servers[server].backoffUntil.Sub(clock.now()); backoff != want {
+			t.Errorf("expected a backoff of %v, got %v", want, backoff)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		infra.failed(server, time.Second)
+	}
+	if backoff := infra.servers[server].backoffUntil.Sub(clock.now()); backoff != maxBackoff {
+		t.Errorf("expected the backoff to stop growing at %v, got %v", maxBackoff, backoff)
+	}
+
+	infra.responded(server, "example.com", 50*time.Millisecond, false)
+	if info := infra.servers[server]; info.timeouts != 0 || !info.backoffUntil.IsZero() {
+		t.Errorf("expected a response to end the backoff, got %+v", info)
+	}
+}
+
+func TestResolver_Lookup_backoff(t *testing.T) {
+	resolver := fakeHierarchy()
+	var logs bytes.Buffer
+	resolver.Logger = log.New(&logs, "", 0)
+	infra, clock := newTestInfra()
+	resolver.infra.now, resolver.infra.intn = infra.now, infra.intn
+	// The first root server cannot be reached.
+	resolver.RootHints = []netip.Addr{netip.MustParseAddr("192.0.2.9"), netip.MustParseAddr("192.0.2.1")}
+	lookup := func() int {
+		t.Helper()
+		logs.Reset()
+		if _, err := resolver.Lookup(context.Background(), "www.example.com", "A"); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(logs.String(), "A @192.0.2.9\n")
+	}
+
+	if sent := lookup(); sent != 1 {
+		t.Errorf("expected the unreachable root server to be queried once, got %d", sent)
+	}
+	if sent := lookup(); sent != 0 {
+		t.Errorf("expected the unreachable root server to be backed off, got %d queries", sent)
+	}
+	clock.advance(minBackoff)
+	if sent := lookup(); sent != 0 {
+		t.Errorf("expected the faster root server to be preferred after the backoff, got %d queries", sent)
+	}
+	resolver.infra.intn = func(n int) int { return 0 }
+	if sent := lookup(); sent != 1 {
+		t.Errorf("expected the unreachable root server to be probed after its backoff, got %d queries", sent)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"net/netip"
 	"strings"
 )
 
@@ -12,158 +14,366 @@ import (
 //
 // [RFC 1035 section 4]: https://datatracker.ietf.org/doc/html/rfc1035#section-4
 type Message struct {
-	// header includes fields that specify which of the remaining fields are present,whether a message is a query
+	// Header includes fields that specify which of the remaining fields are present,whether a message is a query
 	// or a response, a standard query or some other opcode, etc.
-	header    Header
-	questions []Question
-	// answers contains records that answer the question.
-	answers []Record
-	// authorities contains records that point towards an authoritative name server.
-	authorities []Record
-	// additionals contains records that relate to the query, but are not strictly answers to the question.
-	additionals []Record
+	Header Header
+	// Questions contains the questions being asked of the name server.
+	Questions []Question
+	// Answers contains records that answer the question.
+	Answers []Record
+	// Authorities contains records that point towards an authoritative name server.
+	Authorities []Record
+	// Additionals contains records that relate to the query, but are not strictly answers to the question.
+	// The OPT pseudo-record is not included, as its contents are held in EDNS instead.
+	Additionals []Record
+	// EDNS holds the contents of the OPT pseudo-record, or nil if the message does not use EDNS.
+	EDNS *EDNS
+}
+
+// NewQuery returns a Message containing a single question for the given domain name and record type,
+// such as TypeA, in the Internet class.
+func NewQuery(id uint16, domainName string, recordType uint16) Message {
+	return Message{
+		Header:    Header{ID: id, Flags: RecursionOff},
+		Questions: []Question{{Name: []byte(domainName), Type: recordType, Class: ClassIn}},
+	}
 }
 
 // ParseMessage parses a given byte array into a Message.
-func ParseMessage(data []byte) Message {
+// It returns a *ParseError describing where parsing failed if the message is
+// truncated, contains a malformed name, or has bytes left over after the last section.
+func ParseMessage(data []byte) (Message, error) {
 	reader := bytes.NewReader(data)
-	header := ParseHeader(reader)
+	header, err := ParseHeader(reader)
+	if err != nil {
+		return Message{}, err
+	}
 
 	questions := []Question{}
 	var i uint16
 	for i = 0; i < header.NumQuestions; i++ {
-		questions = append(questions, ParseQuestion(reader))
+		question, err := ParseQuestion(reader)
+		if err != nil {
+			return Message{}, err
+		}
+		questions = append(questions, question)
 	}
-	answers := []Record{}
-	for i = 0; i < header.NumAnswers; i++ {
-		answers = append(answers, ParseRecord(reader))
+	answers, err := parseRecords(reader, header.NumAnswers)
+	if err != nil {
+		return Message{}, err
 	}
-	authorities := []Record{}
-	for i = 0; i < header.NumAuthorities; i++ {
-		authorities = append(authorities, ParseRecord(reader))
+	authorities, err := parseRecords(reader, header.NumAuthorities)
+	if err != nil {
+		return Message{}, err
 	}
 	additionals := []Record{}
+	var edns *EDNS
 	for i = 0; i < header.NumAdditionals; i++ {
-		additionals = append(additionals, ParseRecord(reader))
+		start := offset(reader)
+		record, err := ParseRecord(reader)
+		if err != nil {
+			return Message{}, err
+		}
+		if record.Type != TypeOPT {
+			additionals = append(additionals, record)
+			continue
+		}
+		// A message holds at most one OPT pseudo-record, which is always owned by the root.
+		if edns != nil || len(record.Name) != 0 {
+			return Message{}, &ParseError{Offset: start, Err: ErrBadOPT}
+		}
+		edns = ednsFromRecord(record)
 	}
-	return Message{
-		header:      header,
-		questions:   questions,
-		answers:     answers,
-		authorities: authorities,
-		additionals: additionals,
+	if reader.Len() != 0 {
+		return Message{}, &ParseError{Offset: offset(reader), Err: ErrTrailingData}
 	}
+	return Message{
+		Header:      header,
+		Questions:   questions,
+		Answers:     answers,
+		Authorities: authorities,
+		Additionals: additionals,
+		EDNS:        edns,
+	}, nil
 }
 
-// DecodeName returns the first domain name found in the provided reader.
-func DecodeName(reader *bytes.Reader) []byte {
-	var parts []string
-	for length, _ := reader.ReadByte(); int(length) != 0; length, _ = reader.ReadByte() {
+// Pack encodes a Message as bytes, compressing repeated domain names as defined in
+// [RFC 1035 section 4.1.4]. The section counts in the header are taken from the
+// number of entries in each section rather than from the header itself.
+//
+// [RFC 1035 section 4.1.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
+func (p Message) Pack() ([]byte, error) {
+	header := p.Header
+	additionals := p.Additionals
+	if p.EDNS != nil {
+		additionals = append(additionals[:len(additionals):len(additionals)], p.EDNS.record())
+	}
+	counts := []*uint16{&header.NumQuestions, &header.NumAnswers, &header.NumAuthorities, &header.NumAdditionals}
+	lengths := []int{len(p.Questions), len(p.Answers), len(p.Authorities), len(additionals)}
+	for i, count := range counts {
+		if lengths[i] > math.MaxUint16 {
+			return nil, ErrTooManyEntries
+		}
+		*count = uint16(lengths[i])
+	}
 
-		// Check if the first 2 bits are 1s.
-		// Any length starting with 11 means that the name is compressed.
-		if length&0b1100_0000 == 0b1100_0000 {
-			decompressed := DecodeCompressedName(length, reader)
-			parts = append(parts, string(decompressed))
-			// A compressed name is never followed by another label
-			break
-		} else {
-			// Make a new byte array to read
-			rdbuf := make([]byte, length)
-			_, _ = reader.Read(rdbuf)
-			parts = append(parts, string(rdbuf))
+	pk := newPacker()
+	pk.bytes(header.ToBytes())
+	for _, question := range p.Questions {
+		if err := pk.name(string(question.Name), true); err != nil {
+			return nil, err
+		}
+		pk.uint16(question.Type)
+		pk.uint16(question.Class)
+	}
+	for _, section := range [][]Record{p.Answers, p.Authorities, additionals} {
+		for _, record := range section {
+			if err := record.pack(pk); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return []byte(strings.Join(parts, "."))
+	return pk.buf, nil
 }
 
-// DecodeCompressedName extracts a domain name from a compressed message response as defined in
-// [RFC 1035 section 4.1.4].
-//
-// [RFC 1035 section 4.1.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
-func DecodeCompressedName(length byte, reader *bytes.Reader) []byte {
-	// Read a single byte
-	b, _ := reader.ReadByte()
-	// Take the bottom 6 bits of the length byte plus the next byte
-	pointerBytes := [2]byte{length & 0b00111111, b}
-
-	var pointer uint16
-	binary.Read(bytes.NewBuffer(pointerBytes[:]), binary.BigEndian, &pointer)
+// parseRecords parses count consecutive records from the reader.
+func parseRecords(reader *bytes.Reader, count uint16) ([]Record, error) {
+	records := []Record{}
+	var i uint16
+	for i = 0; i < count; i++ {
+		record, err := ParseRecord(reader)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
 
-	currentPosition, err := reader.Seek(0, io.SeekCurrent)
+// DecodeName returns the first domain name found in the provided reader.
+//
+// Compression pointers are followed as long as each one points strictly before the
+// labels that have already been read, which rejects forward pointers and pointer loops.
+// Names longer than 255 bytes in their encoded form are rejected with ErrNameTooLong.
+func DecodeName(reader *bytes.Reader) ([]byte, error) {
+	start := offset(reader)
+	length, err := reader.ReadByte()
 	if err != nil {
-		return []byte("")
+		return nil, &ParseError{Offset: start, Err: ErrTruncated}
 	}
+	return decodeName(length, reader)
+}
 
-	_, err = reader.Seek(int64(pointer), io.SeekStart)
-	if err != nil {
-		return []byte("")
+// DecodeCompressedName extracts a domain name from a compressed message response as defined in
+// [RFC 1035 section 4.1.4]. The length byte is the first byte of the compression pointer,
+// which has already been read from the reader.
+//
+// [RFC 1035 section 4.1.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
+func DecodeCompressedName(length byte, reader *bytes.Reader) ([]byte, error) {
+	if length&0b1100_0000 != 0b1100_0000 {
+		return nil, &ParseError{Offset: offset(reader) - 1, Err: ErrBadLabel}
 	}
-	result := DecodeName(reader)
+	return decodeName(length, reader)
+}
 
-	// Restore the current position in reader
-	_, err = reader.Seek(currentPosition, io.SeekStart)
-	if err != nil {
-		return []byte("")
+// decodeName decodes a domain name whose first length byte has already been read from the reader.
+// When the name is compressed, the reader is left just after the first compression pointer.
+func decodeName(length byte, reader *bytes.Reader) ([]byte, error) {
+	var parts []string
+	// Every label must lie before limit, which starts as the beginning of the name
+	// and moves back to the target of each compression pointer that is followed.
+	limit := offset(reader) - 1
+	// resume is where the reader continues once the name has been read.
+	// It is only set once the first compression pointer is followed.
+	resume := int64(-1)
+	// Account for the zero length byte terminating the name.
+	nameLength := 1
+	for length != 0 {
+		position := offset(reader) - 1
+		switch {
+		// Check if the first 2 bits are 1s.
+		// Any length starting with 11 means that the name is compressed.
+		case length&0b1100_0000 == 0b1100_0000:
+			b, err := reader.ReadByte()
+			if err != nil {
+				return nil, &ParseError{Offset: position, Err: ErrTruncated}
+			}
+			// Take the bottom 6 bits of the length byte plus the next byte
+			pointer := int64(binary.BigEndian.Uint16([]byte{length & 0b0011_1111, b}))
+			if pointer >= position {
+				return nil, &ParseError{Offset: position, Err: ErrBadPointer}
+			}
+			if pointer >= limit {
+				return nil, &ParseError{Offset: position, Err: ErrPointerLoop}
+			}
+			if resume < 0 {
+				resume = offset(reader)
+			}
+			limit = pointer
+			_, _ = reader.Seek(pointer, io.SeekStart)
+		case length&0b1100_0000 != 0:
+			// The 01 and 10 prefixes are reserved, which also rules out labels over 63 bytes.
+			return nil, &ParseError{Offset: position, Err: ErrBadLabel}
+		default:
+			nameLength += int(length) + 1
+			if nameLength > maxNameLength {
+				return nil, &ParseError{Offset: position, Err: ErrNameTooLong}
+			}
+			if int(length) > reader.Len() {
+				return nil, &ParseError{Offset: position + 1, Err: ErrTruncated}
+			}
+			label := make([]byte, length)
+			_, _ = reader.Read(label)
+			parts = append(parts, string(label))
+		}
+
+		var err error
+		if length, err = reader.ReadByte(); err != nil {
+			return nil, &ParseError{Offset: offset(reader), Err: ErrTruncated}
+		}
 	}
 
-	return result
+	// Restore the position in reader to just after the first compression pointer
+	if resume >= 0 {
+		_, _ = reader.Seek(resume, io.SeekStart)
+	}
+	return []byte(strings.Join(parts, ".")), nil
 }
 
 // String formats a Message for printing.
 func (p Message) String() string {
 	return fmt.Sprintf(
 		`Message{
-  header: %s,
-  questions: %+v,
-  answers: %+v,
-  authorities: %+v,
-  additionals: %+v
+  Header: %s,
+  Questions: %+v,
+  Answers: %+v,
+  Authorities: %+v,
+  Additionals: %+v,
+  EDNS: %v
 }`,
-		p.header,
-		p.questions,
-		p.answers,
-		p.authorities,
-		p.additionals,
+		p.Header,
+		p.Questions,
+		p.Answers,
+		p.Authorities,
+		p.Additionals,
+		p.EDNS,
 	)
 }
 
-// GetAnswer returns the Data field from the first A record answer field in the Message.
-func GetAnswer(message Message) []byte {
-	for _, answer := range message.answers {
-		if answer.Type == TypeA {
-			return answer.Data
+// FilterByType returns the records of the given type, such as TypeMX, in their original order.
+func FilterByType(records []Record, recordType uint16) []Record {
+	var filtered []Record
+	for _, record := range records {
+		if record.Type == recordType {
+			filtered = append(filtered, record)
 		}
 	}
-	return nil
+	return filtered
+}
+
+// FilterByName returns the records owned by the given domain name, in their original order.
+// Names are compared case-insensitively, and a trailing dot is ignored.
+func FilterByName(records []Record, domainName string) []Record {
+	var filtered []Record
+	for _, record := range records {
+		if equalNames(string(record.Name), domainName) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+// canonicalName returns the lowercase form of a domain name without a trailing dot,
+// so that names which refer to the same domain compare as equal.
+// Only ASCII letters are folded, as described in RFC 1035 section 2.3.3.
+func canonicalName(domainName string) string {
+	name := []byte(strings.TrimSuffix(domainName, "."))
+	for i, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			name[i] = c + 'a' - 'A'
+		}
+	}
+	return string(name)
+}
+
+// equalNames reports whether two domain names refer to the same domain.
+func equalNames(a, b string) bool {
+	return canonicalName(a) == canonicalName(b)
+}
+
+// GetAnswer returns the address from the first A or AAAA record answer field in the Message
+// whose type matches the type of the question, defaulting to A records when there is no question.
+// The returned address is invalid if there is no such record.
+func GetAnswer(message Message) netip.Addr {
+	var recordType uint16 = TypeA
+	if len(message.Questions) > 0 {
+		recordType = message.Questions[0].Type
+	}
+	for _, answer := range message.Answers {
+		if answer.Type != recordType {
+			continue
+		}
+		if ip := recordAddr(answer); ip.IsValid() {
+			return ip
+		}
+	}
+	return netip.Addr{}
 }
 
-// GetAlias returns the Data field from the first CNAME record answer field in the Message.
+// GetAlias returns the target of the first CNAME record answer field in the Message.
 func GetAlias(message Message) string {
-	for _, answer := range message.answers {
-		if answer.Type == TypeCNAME {
-			return string(answer.Data)
+	for _, answer := range message.Answers {
+		if cname, ok := answer.Data.(*CNAME); ok {
+			return cname.Target
 		}
 	}
 	return ""
 }
 
-// GetNameserverIP returns the Data field from the first A record additional field in the Message.
-func GetNameserverIP(message Message) []byte {
-	for _, additional := range message.additionals {
-		if additional.Type == TypeA {
-			return additional.Data
+// GetNameserverIP returns the address from the first A record additional field in the Message,
+// falling back to the first AAAA record when there is no IPv4 glue.
+// The returned address is invalid if there is no such record.
+func GetNameserverIP(message Message) netip.Addr {
+	var ipv6 netip.Addr
+	for _, additional := range message.Additionals {
+		ip := recordAddr(additional)
+		if ip.Is4() {
+			return ip
+		}
+		if ip.Is6() && !ipv6.IsValid() {
+			ipv6 = ip
 		}
 	}
-	return nil
+	return ipv6
 }
 
-// GetNameserver returns the Data field from the first NS record authority field in the Message.
+// recordAddr returns the address held by an A or AAAA record, or an invalid address for any other record.
+func recordAddr(record Record) netip.Addr {
+	switch data := record.Data.(type) {
+	case *A:
+		return data.Addr
+	case *AAAA:
+		return data.Addr
+	}
+	return netip.Addr{}
+}
+
+// GetNameserver returns the host from the first NS record authority field in the Message.
 func GetNameserver(message Message) string {
-	for _, authority := range message.authorities {
-		if authority.Type == TypeNS {
-			return string(authority.Data)
+	for _, authority := range message.Authorities {
+		if ns, ok := authority.Data.(*NS); ok {
+			return ns.Host
 		}
 	}
 	return ""
 }
+
+// GetSOA returns the first SOA record authority field in the Message, or nil if there is none.
+func GetSOA(message Message) *Record {
+	for i, authority := range message.Authorities {
+		if _, ok := authority.Data.(*SOA); ok {
+			return &message.Authorities[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exampleResponse is a response from 8.8.8.8 for the A record of www.example.com.
+const exampleResponse = "`V\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x03www\x07example\x03com\x00\x00\x01\x00\x01" +
+	"\xc0\x0c\x00\x01\x00\x01\x00\x00R\x9b\x00\x04]\xb8\xd8\""
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantErr    error
+		wantOffset int64
+	}{
+		{
+			name: "valid response",
+			data: exampleResponse,
+		},
+		{
+			name:       "empty",
+			data:       "",
+			wantErr:    ErrTruncated,
+			wantOffset: 0,
+		},
+		{
+			name:       "truncated question",
+			data:       exampleResponse[:20],
+			wantErr:    ErrTruncated,
+			wantOffset: 17,
+		},
+		{
+			name:       "truncated record data",
+			data:       exampleResponse[:len(exampleResponse)-2],
+			wantErr:    ErrTruncated,
+			wantOffset: 45,
+		},
+		{
+			name:       "reserved label type",
+			data:       exampleResponse[:12] + "\x43www" + exampleResponse[16:],
+			wantErr:    ErrBadLabel,
+			wantOffset: 12,
+		},
+		{
+			name:       "trailing data",
+			data:       exampleResponse + "\x00\x00",
+			wantErr:    ErrTrailingData,
+			wantOffset: int64(len(exampleResponse)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseMessage([]byte(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil {
+				return
+			}
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("expected a *ParseError, got %T", err)
+			}
+			if parseErr.Offset != tt.wantOffset {
+				t.Errorf("expected offset %d, got %d", tt.wantOffset, parseErr.Offset)
+			}
+		})
+	}
+}
+
+func TestParseMessage_answer(t *testing.T) {
+	message, err := ParseMessage([]byte(exampleResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetAnswer(message).String(); got != "93.184.216.34" {
+		t.Errorf("expected answer 93.184.216.34, got %s", got)
+	}
+	if got := string(message.Answers[0].Name); got != "www.example.com" {
+		t.Errorf("expected name www.example.com, got %s", got)
+	}
+}
+
+func TestDecodeName(t *testing.T) {
+	label63 := "\x3f" + strings.Repeat("a", 63)
+	tests := []struct {
+		name    string
+		data    string
+		start   int64
+		want    string
+		wantEnd int64
+		wantErr error
+	}{
+		{
+			name:    "uncompressed",
+			data:    "\x03www\x07example\x03com\x00",
+			want:    "www.example.com",
+			wantEnd: 17,
+		},
+		{
+			name:    "root",
+			data:    "\x00",
+			want:    "",
+			wantEnd: 1,
+		},
+		{
+			name:    "compressed suffix",
+			data:    "\x07example\x03com\x00\x03www\xc0\x00",
+			start:   13,
+			want:    "www.example.com",
+			wantEnd: 19,
+		},
+		{
+			name:    "chained pointers",
+			data:    "\x03com\x00\x07example\xc0\x00\x03www\xc0\x05",
+			start:   15,
+			want:    "www.example.com",
+			wantEnd: 21,
+		},
+		{
+			name:    "pointer to itself",
+			data:    "\xc0\x00",
+			wantErr: ErrBadPointer,
+		},
+		{
+			name:    "forward pointer",
+			data:    "\xc0\x02\x03com\x00",
+			wantErr: ErrBadPointer,
+		},
+		{
+			name:    "pointer past the end",
+			data:    "\x03com\x00\xff\xff",
+			start:   5,
+			wantErr: ErrBadPointer,
+		},
+		{
+			name:    "pointer back into the same name",
+			data:    "\x03www\xc0\x00",
+			wantErr: ErrPointerLoop,
+		},
+		{
+			name:    "pointer cycle across names",
+			data:    "\x01a\xc0\x04\x01b\xc0\x00",
+			start:   4,
+			wantErr: ErrBadPointer,
+		},
+		{
+			name:    "label over 63 bytes",
+			data:    "\x40" + strings.Repeat("a", 64) + "\x00",
+			wantErr: ErrBadLabel,
+		},
+		{
+			name:    "name over 255 bytes",
+			data:    strings.Repeat(label63, 4) + "\x00",
+			wantErr: ErrNameTooLong,
+		},
+		{
+			name: "name over 255 bytes through pointers",
+			data: label63 + "\x00" +
+				label63 + "\xc0\x00" +
+				label63 + "\xc0\x41" +
+				label63 + "\xc0\x83",
+			start:   197,
+			wantErr: ErrNameTooLong,
+		},
+		{
+			name:    "truncated label",
+			data:    "\x07exam",
+			wantErr: ErrTruncated,
+		},
+		{
+			name:    "missing terminator",
+			data:    "\x03com",
+			wantErr: ErrTruncated,
+		},
+		{
+			name:    "truncated pointer",
+			data:    "\x03com\x00\xc0",
+			start:   5,
+			wantErr: ErrTruncated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bytes.NewReader([]byte(tt.data))
+			_, _ = reader.Seek(tt.start, io.SeekStart)
+			got, err := DecodeName(reader)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+			if end := offset(reader); end != tt.wantEnd {
+				t.Errorf("expected reader at offset %d, got %d", tt.wantEnd, end)
+			}
+		})
+	}
+}
+
+// FuzzParseMessage also runs the malicious packets in testdata/fuzz/FuzzParseMessage.
+func FuzzParseMessage(f *testing.F) {
+	f.Add([]byte(exampleResponse))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Parsing hostile input must never panic, and any failure must be reported as a *ParseError.
+		message, err := ParseMessage(data)
+		var parseErr *ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			t.Errorf("expected a *ParseError, got %T: %v", err, err)
+		}
+		// Whatever was parsed must also be safe to encode again.
+		_, _ = message.Pack()
+	})
+}
+
+func TestMessage_Pack(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		want    string
+		wantErr error
+	}{
+		{
+			name: "compresses repeated names",
+			message: Message{
+				Header:    Header{ID: 0x6056, Flags: 0x8180},
+				Questions: []Question{{Name: []byte("www.example.com"), Type: TypeA, Class: ClassIn}},
+				Answers: []Record{
+					{Name: []byte("www.example.com"), Type: TypeCNAME, Class: ClassIn, TTL: 60, Data: &CNAME{Target: "web.Example.com"}},
+				},
+				Authorities: []Record{
+					{Name: []byte("example.com"), Type: TypeNS, Class: ClassIn, TTL: 60, Data: &NS{Host: "ns.example.com."}},
+				},
+				Additionals: []Record{
+					{Name: []byte("ns.example.com"), Type: TypeA, Class: ClassIn, TTL: 60, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}},
+				},
+			},
+			want: "`V\x81\x80\x00\x01\x00\x01\x00\x01\x00\x01" +
+				"\x03www\x07example\x03com\x00\x00\x01\x00\x01" +
+				"\xc0\x0c\x00\x05\x00\x01\x00\x00\x00\x3c\x00\x06\x03web\xc0\x10" +
+				"\xc0\x10\x00\x02\x00\x01\x00\x00\x00\x3c\x00\x05\x02ns\xc0\x10" +
+				"\xc0\x3f\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x04\xc0\x00\x02\x01",
+		},
+		{
+			name: "root name",
+			message: Message{
+				Questions: []Question{{Name: []byte("."), Type: TypeNS, Class: ClassIn}},
+			},
+			want: "\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x01",
+		},
+		{
+			name: "empty label",
+			message: Message{
+				Questions: []Question{{Name: []byte("www..com"), Type: TypeA, Class: ClassIn}},
+			},
+			wantErr: ErrBadLabel,
+		},
+		{
+			name: "label over 63 bytes",
+			message: Message{
+				Questions: []Question{{Name: []byte(strings.Repeat("a", 64) + ".com"), Type: TypeA, Class: ClassIn}},
+			},
+			wantErr: ErrBadLabel,
+		},
+		{
+			name: "invalid address",
+			message: Message{
+				Answers: []Record{{Name: []byte("example.com"), Type: TypeA, Class: ClassIn, Data: &A{Addr: netip.MustParseAddr("2001:db8::1")}}},
+			},
+			wantErr: ErrBadRData,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.message.Pack()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected %q but got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMessage_Pack_roundTrip(t *testing.T) {
+	message, err := ParseMessage([]byte(exampleResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != exampleResponse {
+		t.Errorf("expected %q but got %q", exampleResponse, got)
+	}
+}
+
+func TestGetAnswer(t *testing.T) {
+	message := Message{
+		Answers: []Record{
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIn, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}},
+			{Name: []byte("example.com"), Type: TypeAAAA, Class: ClassIn, Data: &AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+		},
+	}
+	tests := []struct {
+		name       string
+		recordType uint16
+		want       netip.Addr
+	}{
+		{name: "A", recordType: TypeA, want: netip.MustParseAddr("192.0.2.1")},
+		{name: "AAAA", recordType: TypeAAAA, want: netip.MustParseAddr("2001:db8::1")},
+		{name: "no matching answer", recordType: TypeMX, want: netip.Addr{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message.Questions = []Question{{Name: []byte("example.com"), Type: tt.recordType, Class: ClassIn}}
+			if got := GetAnswer(message); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetNameserverIP(t *testing.T) {
+	ipv4Glue := Record{Name: []byte("ns1.example.com"), Type: TypeA, Class: ClassIn, Data: &A{Addr: netip.MustParseAddr("192.0.2.53")}}
+	ipv6Glue := Record{Name: []byte("ns1.example.com"), Type: TypeAAAA, Class: ClassIn, Data: &AAAA{Addr: netip.MustParseAddr("2001:db8::53")}}
+	tests := []struct {
+		name        string
+		additionals []Record
+		want        netip.Addr
+	}{
+		{name: "prefers IPv4 glue", additionals: []Record{ipv6Glue, ipv4Glue}, want: netip.MustParseAddr("192.0.2.53")},
+		{name: "IPv6 only glue", additionals: []Record{ipv6Glue}, want: netip.MustParseAddr("2001:db8::53")},
+		{name: "no glue", additionals: nil, want: netip.Addr{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetNameserverIP(Message{Additionals: tt.additionals}); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFilterRecords(t *testing.T) {
+	records := []Record{
+		{Name: []byte("example.com"), Type: TypeMX, Class: ClassIn, Data: &MX{Preference: 10, Exchange: "mail.example.com"}},
+		{Name: []byte("WWW.Example.com."), Type: TypeA, Class: ClassIn, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		{Name: []byte("example.com"), Type: TypeMX, Class: ClassIn, Data: &MX{Preference: 20, Exchange: "backup.example.com"}},
+		{Name: []byte("www.example.com"), Type: TypeAAAA, Class: ClassIn, Data: &AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+	}
+	tests := []struct {
+		name string
+		got  []Record
+		want []Record
+	}{
+		{name: "by type", got: FilterByType(records, TypeMX), want: []Record{records[0], records[2]}},
+		{name: "by type without matches", got: FilterByType(records, TypeTXT), want: nil},
+		{name: "by name", got: FilterByName(records, "www.example.com"), want: []Record{records[1], records[3]}},
+		{name: "by name and type", got: FilterByType(FilterByName(records, "www.EXAMPLE.com."), TypeA), want: []Record{records[1]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, tt.got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	// maxLabelLength is the maximum number of bytes in a single label of a domain name.
+	maxLabelLength = 63
+	// maxPointer is the largest offset that a compression pointer can refer to.
+	maxPointer = 0b0011_1111_1111_1111
+)
+
+// packer encodes the parts of a message into a single buffer, compressing
+// domain names by referring back to names that have already been written,
+// as defined in [RFC 1035 section 4.1.4].
+//
+// [RFC 1035 section 4.1.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
+type packer struct {
+	buf []byte
+	// names maps each name suffix written so far to its offset in buf.
+	// A nil map disables compression.
+	names map[string]int
+}
+
+// newPacker returns a packer that compresses the names it writes.
+func newPacker() *packer {
+	return &packer{names: map[string]int{}}
+}
+
+func (p *packer) uint8(v uint8) {
+	p.buf = append(p.buf, v)
+}
+
+func (p *packer) uint16(v uint16) {
+	p.buf = binary.BigEndian.AppendUint16(p.buf, v)
+}
+
+func (p *packer) uint32(v uint32) {
+	p.buf = binary.BigEndian.AppendUint32(p.buf, v)
+}
+
+func (p *packer) bytes(b []byte) {
+	p.buf = append(p.buf, b...)
+}
+
+// string writes a character string, a length byte followed by at most 255 bytes.
+func (p *packer) string(s string) error {
+	if len(s) > 255 {
+		return ErrBadRData
+	}
+	p.uint8(uint8(len(s)))
+	p.bytes([]byte(s))
+	return nil
+}
+
+// name writes a domain name as a sequence of labels. When compress is true and a suffix
+// of the name has already been written, a pointer to the earlier suffix is written instead.
+func (p *packer) name(domainName string, compress bool) error {
+	labels, err := splitName(domainName)
+	if err != nil {
+		return err
+	}
+	for i := range labels {
+		// Names are compared case-insensitively, as described in RFC 1035 section 2.3.3.
+		suffix := canonicalName(strings.Join(labels[i:], "."))
+		if pointer, ok := p.names[suffix]; ok && compress {
+			p.uint16(0b1100_0000_0000_0000 | uint16(pointer))
+			return nil
+		}
+		if p.names != nil && len(p.buf) <= maxPointer {
+			p.names[suffix] = len(p.buf)
+		}
+		p.uint8(uint8(len(labels[i])))
+		p.bytes([]byte(labels[i]))
+	}
+	p.uint8(0)
+	return nil
+}
+
+// splitName splits a domain name into its labels, checking that each label and
+// the name as a whole fit within the limits of [RFC 1035 section 2.3.4].
+// The root name may be given as either "" or ".".
+//
+// [RFC 1035 section 2.3.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-2.3.4
+func splitName(domainName string) ([]string, error) {
+	domainName = strings.TrimSuffix(domainName, ".")
+	if domainName == "" {
+		return nil, nil
+	}
+	labels := strings.Split(domainName, ".")
+	// Account for the zero length byte terminating the name.
+	nameLength := 1
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > maxLabelLength {
+			return nil, ErrBadLabel
+		}
+		nameLength += len(label) + 1
+	}
+	if nameLength > maxNameLength {
+		return nil, ErrNameTooLong
+	}
+	return labels, nil
+}
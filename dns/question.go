@@ -3,10 +3,14 @@ package dns
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"strings"
 )
 
+// maxNameLength is the maximum number of bytes in an encoded domain name.
+const maxNameLength = 255
+
 type Question struct {
 	// Name represents the query domain name.
 	Name []byte
@@ -17,14 +21,16 @@ type Question struct {
 }
 
 // ParseQuestion parses a given bytes reader into a Question.
-func ParseQuestion(reader *bytes.Reader) Question {
+func ParseQuestion(reader *bytes.Reader) (Question, error) {
 	q := Question{}
-	q.Name = DecodeName(reader)
-
-	binary.Read(reader, binary.BigEndian, &q.Type)
-	binary.Read(reader, binary.BigEndian, &q.Class)
+	name, err := DecodeName(reader)
+	if err != nil {
+		return q, err
+	}
+	q.Name = name
 
-	return q
+	err = readBigEndian(reader, &q.Type, &q.Class)
+	return q, err
 }
 
 // ToBytes encodes a Question as bytes.
@@ -60,6 +66,15 @@ func EncodeName(domainName string) []byte {
 	return buf.Bytes()
 }
 
+// MarshalJSON encodes the question with its name as a string rather than as base64.
+func (q Question) MarshalJSON() ([]byte, error) {
+	type question Question
+	return json.Marshal(struct {
+		Name string
+		question
+	}{Name: string(q.Name), question: question(q)})
+}
+
 func (q Question) String() string {
 	return fmt.Sprintf(`Question{
     Name: %s,
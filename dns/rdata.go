@@ -0,0 +1,472 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// RData is the type-specific content of a resource record, such as the address of an A record
+// or the mail exchange of an MX record. Each implementation decodes, encodes and formats
+// the RDATA field of its record type as defined in [RFC 1035 section 3.3].
+//
+// [RFC 1035 section 3.3]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3
+type RData interface {
+	fmt.Stringer
+	// unpack decodes length bytes of record data starting at the current position of the reader.
+	// The reader covers the whole message, so that compressed names can be decompressed.
+	unpack(reader *bytes.Reader, length uint16) error
+	// pack encodes the record data into the packer.
+	pack(p *packer) error
+}
+
+// newRData returns an empty RData of the concrete type used for the given record type.
+// Record types without a dedicated implementation use Unknown.
+func newRData(recordType uint16) RData {
+	switch recordType {
+	case TypeA:
+		return &A{}
+	case TypeNS:
+		return &NS{}
+	case TypeCNAME:
+		return &CNAME{}
+	case TypeSOA:
+		return &SOA{}
+	case TypeNULL:
+		return &NULL{}
+	case TypeWKS:
+		return &WKS{}
+	case TypePTR:
+		return &PTR{}
+	case TypeHINFO:
+		return &HINFO{}
+	case TypeMINFO:
+		return &MINFO{}
+	case TypeMX:
+		return &MX{}
+	case TypeTXT:
+		return &TXT{}
+	case TypeAAAA:
+		return &AAAA{}
+	case TypeOPT:
+		return &OPT{}
+	default:
+		return &Unknown{}
+	}
+}
+
+// A is the data of an A record, a 32 bit Internet address.
+type A struct {
+	Addr netip.Addr
+}
+
+func (a *A) unpack(reader *bytes.Reader, length uint16) error {
+	if length != 4 {
+		return &ParseError{Offset: offset(reader), Err: ErrBadRData}
+	}
+	var ip [4]byte
+	_, _ = reader.Read(ip[:])
+	a.Addr = netip.AddrFrom4(ip)
+	return nil
+}
+
+func (a *A) pack(p *packer) error {
+	if !a.Addr.Is4() {
+		return ErrBadRData
+	}
+	ip := a.Addr.As4()
+	p.bytes(ip[:])
+	return nil
+}
+
+func (a *A) String() string {
+	return a.Addr.String()
+}
+
+// AAAA is the data of an AAAA record, a 128 bit IPv6 address.
+type AAAA struct {
+	Addr netip.Addr
+}
+
+func (a *AAAA) unpack(reader *bytes.Reader, length uint16) error {
+	if length != 16 {
+		return &ParseError{Offset: offset(reader), Err: ErrBadRData}
+	}
+	var ip [16]byte
+	_, _ = reader.Read(ip[:])
+	a.Addr = netip.AddrFrom16(ip)
+	return nil
+}
+
+func (a *AAAA) pack(p *packer) error {
+	if !a.Addr.Is6() || a.Addr.Is4In6() {
+		return ErrBadRData
+	}
+	ip := a.Addr.As16()
+	p.bytes(ip[:])
+	return nil
+}
+
+func (a *AAAA) String() string {
+	return a.Addr.String()
+}
+
+// NS is the data of an NS record, the name of a host that should be authoritative for the domain.
+type NS struct {
+	Host string
+}
+
+func (ns *NS) unpack(reader *bytes.Reader, _ uint16) error {
+	var err error
+	ns.Host, err = unpackName(reader)
+	return err
+}
+
+func (ns *NS) pack(p *packer) error {
+	return p.name(ns.Host, true)
+}
+
+func (ns *NS) String() string {
+	return ns.Host
+}
+
+// CNAME is the data of a CNAME record, the canonical name for the owner of the record.
+type CNAME struct {
+	Target string
+}
+
+func (c *CNAME) unpack(reader *bytes.Reader, _ uint16) error {
+	var err error
+	c.Target, err = unpackName(reader)
+	return err
+}
+
+func (c *CNAME) pack(p *packer) error {
+	return p.name(c.Target, true)
+}
+
+func (c *CNAME) String() string {
+	return c.Target
+}
+
+// PTR is the data of a PTR record, a name which points to some location in the domain name space.
+type PTR struct {
+	Ptr string
+}
+
+func (ptr *PTR) unpack(reader *bytes.Reader, _ uint16) error {
+	var err error
+	ptr.Ptr, err = unpackName(reader)
+	return err
+}
+
+func (ptr *PTR) pack(p *packer) error {
+	return p.name(ptr.Ptr, true)
+}
+
+func (ptr *PTR) String() string {
+	return ptr.Ptr
+}
+
+// SOA is the data of an SOA record, which marks the start of a zone of authority.
+type SOA struct {
+	// MName is the name of the name server that was the original or primary source of data for this zone.
+	MName string
+	// RName is the mailbox of the person responsible for this zone.
+	RName string
+	// Serial is the version number of the original copy of the zone.
+	Serial uint32
+	// Refresh is the time interval in seconds before the zone should be refreshed.
+	Refresh uint32
+	// Retry is the time interval in seconds that should elapse before a failed refresh should be retried.
+	Retry uint32
+	// Expire is the upper limit in seconds on the time interval that can elapse before
+	// the zone is no longer authoritative.
+	Expire uint32
+	// Minimum is the minimum TTL that should be exported with any record from this zone.
+	Minimum uint32
+}
+
+func (soa *SOA) unpack(reader *bytes.Reader, _ uint16) error {
+	var err error
+	if soa.MName, err = unpackName(reader); err != nil {
+		return err
+	}
+	if soa.RName, err = unpackName(reader); err != nil {
+		return err
+	}
+	return readBigEndian(reader, &soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum)
+}
+
+func (soa *SOA) pack(p *packer) error {
+	if err := p.name(soa.MName, true); err != nil {
+		return err
+	}
+	if err := p.name(soa.RName, true); err != nil {
+		return err
+	}
+	p.uint32(soa.Serial)
+	p.uint32(soa.Refresh)
+	p.uint32(soa.Retry)
+	p.uint32(soa.Expire)
+	p.uint32(soa.Minimum)
+	return nil
+}
+
+func (soa *SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d",
+		soa.MName, soa.RName, soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+}
+
+// MX is the data of an MX record, a host willing to act as a mail exchange for the owner name.
+type MX struct {
+	// Preference specifies the preference given to this record among others at the same owner.
+	// Lower values are preferred.
+	Preference uint16
+	// Exchange is the name of the host willing to act as a mail exchange.
+	Exchange string
+}
+
+func (mx *MX) unpack(reader *bytes.Reader, _ uint16) error {
+	if err := readBigEndian(reader, &mx.Preference); err != nil {
+		return err
+	}
+	var err error
+	mx.Exchange, err = unpackName(reader)
+	return err
+}
+
+func (mx *MX) pack(p *packer) error {
+	p.uint16(mx.Preference)
+	return p.name(mx.Exchange, true)
+}
+
+func (mx *MX) String() string {
+	return fmt.Sprintf("%d %s", mx.Preference, mx.Exchange)
+}
+
+// TXT is the data of a TXT record, one or more character strings.
+type TXT struct {
+	Text []string
+}
+
+func (txt *TXT) unpack(reader *bytes.Reader, length uint16) error {
+	end := offset(reader) + int64(length)
+	txt.Text = nil
+	for offset(reader) < end {
+		s, err := unpackString(reader, end)
+		if err != nil {
+			return err
+		}
+		txt.Text = append(txt.Text, s)
+	}
+	return nil
+}
+
+func (txt *TXT) pack(p *packer) error {
+	for _, s := range txt.Text {
+		if err := p.string(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (txt *TXT) String() string {
+	return quoteStrings(txt.Text...)
+}
+
+// HINFO is the data of an HINFO record, which describes the CPU and operating system of a host.
+type HINFO struct {
+	CPU string
+	OS  string
+}
+
+func (h *HINFO) unpack(reader *bytes.Reader, length uint16) error {
+	end := offset(reader) + int64(length)
+	var err error
+	if h.CPU, err = unpackString(reader, end); err != nil {
+		return err
+	}
+	h.OS, err = unpackString(reader, end)
+	return err
+}
+
+func (h *HINFO) pack(p *packer) error {
+	if err := p.string(h.CPU); err != nil {
+		return err
+	}
+	return p.string(h.OS)
+}
+
+func (h *HINFO) String() string {
+	return quoteStrings(h.CPU, h.OS)
+}
+
+// MINFO is the data of an MINFO record, which describes the mailboxes of a mailing list.
+type MINFO struct {
+	// RMailbox is the mailbox responsible for the mailing list.
+	RMailbox string
+	// EMailbox is the mailbox that receives error messages related to the mailing list.
+	EMailbox string
+}
+
+func (m *MINFO) unpack(reader *bytes.Reader, _ uint16) error {
+	var err error
+	if m.RMailbox, err = unpackName(reader); err != nil {
+		return err
+	}
+	m.EMailbox, err = unpackName(reader)
+	return err
+}
+
+func (m *MINFO) pack(p *packer) error {
+	if err := p.name(m.RMailbox, true); err != nil {
+		return err
+	}
+	return p.name(m.EMailbox, true)
+}
+
+func (m *MINFO) String() string {
+	return fmt.Sprintf("%s %s", m.RMailbox, m.EMailbox)
+}
+
+// WKS is the data of a WKS record, which describes the well known services supported
+// by a particular protocol on a particular Internet address.
+type WKS struct {
+	Address netip.Addr
+	// Protocol is an IP protocol number, such as 6 for TCP or 17 for UDP.
+	Protocol uint8
+	// Bitmap has one bit per port of the protocol, set when a service is offered on that port.
+	// The first bit of the first byte corresponds to port 0.
+	Bitmap []byte
+}
+
+func (w *WKS) unpack(reader *bytes.Reader, length uint16) error {
+	if length < 5 {
+		return &ParseError{Offset: offset(reader), Err: ErrBadRData}
+	}
+	var ip [4]byte
+	_, _ = reader.Read(ip[:])
+	w.Address = netip.AddrFrom4(ip)
+	w.Protocol, _ = reader.ReadByte()
+	w.Bitmap = make([]byte, length-5)
+	_, _ = reader.Read(w.Bitmap)
+	return nil
+}
+
+func (w *WKS) pack(p *packer) error {
+	if !w.Address.Is4() {
+		return ErrBadRData
+	}
+	ip := w.Address.As4()
+	p.bytes(ip[:])
+	p.uint8(w.Protocol)
+	p.bytes(w.Bitmap)
+	return nil
+}
+
+// Ports returns the ports whose bit is set in the bitmap.
+func (w *WKS) Ports() []uint16 {
+	var ports []uint16
+	for i, b := range w.Bitmap {
+		for bit := 0; bit < 8; bit++ {
+			if b&(0b1000_0000>>bit) != 0 {
+				ports = append(ports, uint16(i*8+bit))
+			}
+		}
+	}
+	return ports
+}
+
+func (w *WKS) String() string {
+	parts := []string{w.Address.String(), strconv.Itoa(int(w.Protocol))}
+	for _, port := range w.Ports() {
+		parts = append(parts, strconv.Itoa(int(port)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// NULL is the data of a NULL record, which may hold anything up to 65535 bytes.
+type NULL struct {
+	Data []byte
+}
+
+func (n *NULL) unpack(reader *bytes.Reader, length uint16) error {
+	n.Data = make([]byte, length)
+	_, _ = reader.Read(n.Data)
+	return nil
+}
+
+func (n *NULL) pack(p *packer) error {
+	p.bytes(n.Data)
+	return nil
+}
+
+func (n *NULL) String() string {
+	return unknownString(n.Data)
+}
+
+// Unknown is the data of a record whose type has no dedicated RData implementation.
+// The data is kept exactly as it appeared in the message.
+type Unknown struct {
+	Data []byte
+}
+
+func (u *Unknown) unpack(reader *bytes.Reader, length uint16) error {
+	u.Data = make([]byte, length)
+	_, _ = reader.Read(u.Data)
+	return nil
+}
+
+func (u *Unknown) pack(p *packer) error {
+	p.bytes(u.Data)
+	return nil
+}
+
+func (u *Unknown) String() string {
+	return unknownString(u.Data)
+}
+
+// unknownString formats opaque record data in the generic format defined in [RFC 3597 section 5].
+//
+// [RFC 3597 section 5]: https://datatracker.ietf.org/doc/html/rfc3597#section-5
+func unknownString(data []byte) string {
+	if len(data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(data), hex.EncodeToString(data))
+}
+
+// quoteStrings formats character strings as a space separated list of quoted strings.
+func quoteStrings(s ...string) string {
+	quoted := make([]string, len(s))
+	for i := range s {
+		quoted[i] = strconv.Quote(s[i])
+	}
+	return strings.Join(quoted, " ")
+}
+
+// unpackName decodes a domain name from the reader.
+func unpackName(reader *bytes.Reader) (string, error) {
+	name, err := DecodeName(reader)
+	return string(name), err
+}
+
+// unpackString decodes a character string, a length byte followed by that many bytes,
+// as defined in [RFC 1035 section 3.3]. The string must end before the end offset.
+//
+// [RFC 1035 section 3.3]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3
+func unpackString(reader *bytes.Reader, end int64) (string, error) {
+	start := offset(reader)
+	length, err := reader.ReadByte()
+	if err != nil || start+1+int64(length) > end {
+		return "", &ParseError{Offset: start, Err: ErrBadRData}
+	}
+	s := make([]byte, length)
+	_, _ = reader.Read(s)
+	return string(s), nil
+}
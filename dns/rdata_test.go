@@ -0,0 +1,157 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestRData_roundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordType uint16
+		data       RData
+		wantString string
+	}{
+		{
+			name:       "A",
+			recordType: TypeA,
+			data:       &A{Addr: netip.MustParseAddr("192.0.2.1")},
+			wantString: "192.0.2.1",
+		},
+		{
+			name:       "AAAA",
+			recordType: TypeAAAA,
+			data:       &AAAA{Addr: netip.MustParseAddr("2001:db8::1")},
+			wantString: "2001:db8::1",
+		},
+		{
+			name:       "NS",
+			recordType: TypeNS,
+			data:       &NS{Host: "ns1.example.com"},
+			wantString: "ns1.example.com",
+		},
+		{
+			name:       "CNAME",
+			recordType: TypeCNAME,
+			data:       &CNAME{Target: "www.example.com"},
+			wantString: "www.example.com",
+		},
+		{
+			name:       "PTR",
+			recordType: TypePTR,
+			data:       &PTR{Ptr: "host.example.com"},
+			wantString: "host.example.com",
+		},
+		{
+			name:       "SOA",
+			recordType: TypeSOA,
+			data: &SOA{
+				MName:   "ns1.example.com",
+				RName:   "hostmaster.example.com",
+				Serial:  2023100101,
+				Refresh: 7200,
+				Retry:   3600,
+				Expire:  1209600,
+				Minimum: 300,
+			},
+			wantString: "ns1.example.com hostmaster.example.com 2023100101 7200 3600 1209600 300",
+		},
+		{
+			name:       "MX",
+			recordType: TypeMX,
+			data:       &MX{Preference: 10, Exchange: "mail.example.com"},
+			wantString: "10 mail.example.com",
+		},
+		{
+			name:       "TXT",
+			recordType: TypeTXT,
+			data:       &TXT{Text: []string{"v=spf1 -all", `say "hi"`}},
+			wantString: `"v=spf1 -all" "say \"hi\""`,
+		},
+		{
+			name:       "HINFO",
+			recordType: TypeHINFO,
+			data:       &HINFO{CPU: "RFC8482", OS: ""},
+			wantString: `"RFC8482" ""`,
+		},
+		{
+			name:       "MINFO",
+			recordType: TypeMINFO,
+			data:       &MINFO{RMailbox: "list-admin.example.com", EMailbox: "list-errors.example.com"},
+			wantString: "list-admin.example.com list-errors.example.com",
+		},
+		{
+			name:       "WKS",
+			recordType: TypeWKS,
+			data:       &WKS{Address: netip.MustParseAddr("192.0.2.1"), Protocol: 6, Bitmap: []byte{0, 0, 0b0100_0000, 0b0000_0100}},
+			wantString: "192.0.2.1 6 17 29",
+		},
+		{
+			name:       "NULL",
+			recordType: TypeNULL,
+			data:       &NULL{Data: []byte{0xde, 0xad}},
+			wantString: `\# 2 dead`,
+		},
+		{
+			name:       "unknown type",
+			recordType: 65280,
+			data:       &Unknown{Data: []byte{0x01, 0x02, 0x03}},
+			wantString: `\# 3 010203`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := Message{
+				Answers: []Record{
+					{Name: []byte("example.com"), Type: tt.recordType, Class: ClassIn, TTL: 60, Data: tt.data},
+				},
+			}
+			packed, err := message.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseMessage(packed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := parsed.Answers[0].Data
+			if !reflect.DeepEqual(got, tt.data) {
+				t.Errorf("expected %#v, got %#v", tt.data, got)
+			}
+			if got.String() != tt.wantString {
+				t.Errorf("expected %q, got %q", tt.wantString, got.String())
+			}
+		})
+	}
+}
+
+func TestParseRecord_badRData(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "A record with IPv6 length",
+			data: "\x00\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x10" + "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01",
+		},
+		{
+			name: "name longer than data length",
+			data: "\x00\x00\x05\x00\x01\x00\x00\x00\x3c\x00\x02\x03www\x00",
+		},
+		{
+			name: "character string longer than data length",
+			data: "\x00\x00\x10\x00\x01\x00\x00\x00\x3c\x00\x03\x05hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRecord(bytes.NewReader([]byte(tt.data)))
+			if !errors.Is(err, ErrBadRData) {
+				t.Errorf("expected error %v, got %v", ErrBadRData, err)
+			}
+		})
+	}
+}
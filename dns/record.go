@@ -3,14 +3,14 @@ package dns
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"io"
+	"math"
+	"net/netip"
 )
 
 const (
 	ClassIn = 1
-	// IP Address for a.root-servers.net
-	rootNameserver = "198.41.0.4"
 )
 
 const (
@@ -32,6 +32,11 @@ const (
 	TypeTXT
 )
 
+// TypeAAAA is the record type of an IPv6 host address as defined in [RFC 3596 section 2.1].
+//
+// [RFC 3596 section 2.1]: https://datatracker.ietf.org/doc/html/rfc3596#section-2.1
+const TypeAAAA = 28
+
 type RecordType struct {
 	Name    string
 	Value   uint16
@@ -39,9 +44,12 @@ type RecordType struct {
 }
 
 // RecordTypes represents all possible resource record type field values
-// as defined in [RFC 1035 section 3.2.2].
+// as defined in [RFC 1035 section 3.2.2], along with the AAAA type from [RFC 3596]
+// and the OPT pseudo-record type from [RFC 6891].
 //
 // [RFC 1035 section 3.2.2]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.2.2
+// [RFC 3596]: https://datatracker.ietf.org/doc/html/rfc3596
+// [RFC 6891]: https://datatracker.ietf.org/doc/html/rfc6891
 var RecordTypes = map[string]RecordType{
 	"A": {
 		Name:    "A",
@@ -123,6 +131,27 @@ var RecordTypes = map[string]RecordType{
 		Value:   TypeTXT,
 		Meaning: "text strings",
 	},
+	"AAAA": {
+		Name:    "AAAA",
+		Value:   TypeAAAA,
+		Meaning: "an IPv6 host address",
+	},
+	"OPT": {
+		Name:    "OPT",
+		Value:   TypeOPT,
+		Meaning: "an EDNS(0) option pseudo-record",
+	},
+}
+
+// TypeString returns the name of a record type, such as "MX", or "TYPE" followed by
+// the numeric value for types that are not in RecordTypes.
+func TypeString(recordType uint16) string {
+	for name, t := range RecordTypes {
+		if t.Value == recordType {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", recordType)
 }
 
 // Record represents a DNS resource record as defined in [RFC 1035 section 3.2.1].
@@ -137,63 +166,106 @@ type Record struct {
 	// TTL represents the time-to-live of the cache entry for the query.
 	TTL int32
 	// Data contains the records content, such as the IP address.
-	Data []byte
+	// Its concrete type depends on Type, for example *A for an A record or *MX for an MX record.
+	Data RData
 }
 
 // ParseRecord parses a given bytes reader into a record.
-func ParseRecord(reader *bytes.Reader) Record {
+func ParseRecord(reader *bytes.Reader) (Record, error) {
 	record := Record{}
 
-	record.Name = DecodeName(reader)
-
-	binary.Read(reader, binary.BigEndian, &record.Type)
-	binary.Read(reader, binary.BigEndian, &record.Class)
-	binary.Read(reader, binary.BigEndian, &record.TTL)
+	name, err := DecodeName(reader)
+	if err != nil {
+		return record, err
+	}
+	record.Name = name
 
 	var dataLength uint16
-	binary.Read(reader, binary.BigEndian, &dataLength)
-	data := make([]byte, dataLength)
+	err = readBigEndian(reader, &record.Type, &record.Class, &record.TTL, &dataLength)
+	if err != nil {
+		return record, err
+	}
+
 	// Save the offset before reading the data field.
-	beforeData, _ := reader.Seek(0, io.SeekCurrent)
-	binary.Read(reader, binary.BigEndian, &data)
-
-	switch record.Type {
-	case TypeNS:
-		record.Data = DecodeName(bytes.NewReader(data))
-	case TypeA:
-		record.Data = []byte(IPString(data))
-	case TypeCNAME:
-		// Seek back in the reader to before the name, so that
-		// DecodeName can decompress the name by referring to bytes
-		// anywhere in the response.
-		reader.Seek(beforeData, io.SeekStart)
-		record.Data = DecodeName(reader)
-	default:
-		record.Data = data
+	beforeData := offset(reader)
+	if int64(dataLength) > int64(reader.Len()) {
+		return record, &ParseError{Offset: beforeData, Err: ErrTruncated}
 	}
 
-	return record
+	// The data is decoded from the message reader rather than from a copy of the data field,
+	// so that names within it can be decompressed by referring to bytes anywhere in the response.
+	record.Data = newRData(record.Type)
+	if err = record.Data.unpack(reader, dataLength); err != nil {
+		return record, err
+	}
+	if offset(reader) != beforeData+int64(dataLength) {
+		return record, &ParseError{Offset: beforeData, Err: ErrBadRData}
+	}
+
+	return record, nil
 }
 
-// IPString converts a byte array into a dotted IP format.
+// ToBytes encodes a Record as bytes, without compressing any of its domain names.
+func (r *Record) ToBytes() ([]byte, error) {
+	p := &packer{}
+	if err := r.pack(p); err != nil {
+		return nil, err
+	}
+	return p.buf, nil
+}
+
+// pack encodes a Record into the packer, including the data length that precedes the data field.
+func (r *Record) pack(p *packer) error {
+	if err := p.name(string(r.Name), true); err != nil {
+		return err
+	}
+	p.uint16(r.Type)
+	p.uint16(r.Class)
+	p.uint32(uint32(r.TTL))
+
+	// Reserve space for the data length, and fill it in once the data has been written.
+	lengthOffset := len(p.buf)
+	p.uint16(0)
+	if r.Data == nil {
+		return ErrBadRData
+	}
+	if err := r.Data.pack(p); err != nil {
+		return err
+	}
+	dataLength := len(p.buf) - lengthOffset - 2
+	if dataLength > math.MaxUint16 {
+		return ErrBadRData
+	}
+	binary.BigEndian.PutUint16(p.buf[lengthOffset:], uint16(dataLength))
+	return nil
+}
+
+// IPString converts a 4 byte array into a dotted IP format, or a 16 byte array into an IPv6 address.
 func IPString(data []byte) string {
+	if len(data) == 16 {
+		return netip.AddrFrom16([16]byte(data)).String()
+	}
 	if len(data) < 4 {
 		return "?.?.?.?"
 	}
 	return fmt.Sprintf("%v.%v.%v.%v", data[0], data[1], data[2], data[3])
 }
 
-func (r Record) String() string {
-	data := r.Data
-	if r.Type == TypeA {
-		data = []byte(IPString(r.Data))
-	}
+// MarshalJSON encodes the record with its name as a string rather than as base64.
+func (r Record) MarshalJSON() ([]byte, error) {
+	type record Record
+	return json.Marshal(struct {
+		Name string
+		record
+	}{Name: string(r.Name), record: record(r)})
+}
 
+func (r Record) String() string {
 	return fmt.Sprintf(`Record{
     Name: %s,
     Type: %d,
     Class: %d,
     TTL: %d,
-    Data: %s
-  }`, r.Name, r.Type, r.Class, r.TTL, data)
+    Data: %v
+  }`, r.Name, r.Type, r.Class, r.TTL, r.Data)
 }
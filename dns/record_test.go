@@ -0,0 +1,36 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRecord_toBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		record Record
+		want   string
+	}{
+		{
+			name:   "A",
+			record: Record{Name: []byte("example.com"), Type: TypeA, Class: ClassIn, TTL: 300, Data: &A{Addr: netip.MustParseAddr("93.184.216.34")}},
+			want:   "\x07example\x03com\x00\x00\x01\x00\x01\x00\x00\x01\x2c\x00\x04]\xb8\xd8\"",
+		},
+		{
+			name:   "CNAME is not compressed",
+			record: Record{Name: []byte("www.example.com"), Type: TypeCNAME, Class: ClassIn, TTL: 300, Data: &CNAME{Target: "example.com"}},
+			want:   "\x03www\x07example\x03com\x00\x00\x05\x00\x01\x00\x00\x01\x2c\x00\x0d\x07example\x03com\x00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.record.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected %q but got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,10 +1,16 @@
 package dns
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
-	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lucasmelin/dinosaur/dino"
@@ -15,6 +21,116 @@ const (
 	RecursionOff     = 0
 )
 
+const (
+	// DefaultPort is the port that name servers are queried on unless a Resolver specifies another.
+	DefaultPort = 53
+	// DefaultTimeout is the longest time to wait for a name server to respond to a single query
+	// unless a Resolver specifies another.
+	DefaultTimeout = 5 * time.Second
+	// DefaultRetryBackoff is how long to wait before retrying the name servers of a referral for
+	// the first time, unless a Resolver specifies another.
+	DefaultRetryBackoff = 250 * time.Millisecond
+	// DefaultMaxDepth is how deeply resolutions may nest unless a Resolver specifies another.
+	DefaultMaxDepth = 8
+)
+
+// maxCNAMEChain is the largest number of aliases followed while resolving a single name.
+const maxCNAMEChain = 8
+
+// Resolver resolves domain names by querying name servers iteratively, starting from the root.
+// The zero value is ready to use, and queries the root servers on port 53 without retries.
+// The exported fields of a Resolver must not be modified while it is in use, and a Resolver
+// must not be copied after first use.
+type Resolver struct {
+	// RootHints are the addresses of the root name servers that every resolution starts from,
+	// such as those returned by ParseRootHints. If empty, DefaultRootHints is used.
+	RootHints []netip.Addr
+	// Port is the port that name servers are queried on. If zero, DefaultPort is used.
+	Port uint16
+	// Timeout is the longest time to wait for a name server to respond to a single query,
+	// including any retry over TCP. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+	// Retries is the number of times the name servers of a referral are retried after all of them have failed.
+	Retries int
+	// RetryBackoff is how long to wait before retrying the name servers of a referral for the first time.
+	// The wait doubles with each further retry. If zero, DefaultRetryBackoff is used.
+	RetryBackoff time.Duration
+	// MaxDepth limits how deeply a resolution may nest to resolve the addresses of name servers
+	// that were referred to without glue. If zero, DefaultMaxDepth is used.
+	MaxDepth int
+	// MaxQueries limits the number of queries sent by a single resolution, including the queries of
+	// every resolution nested within it. If zero, DefaultMaxQueries is used.
+	MaxQueries int
+	// MaxDuration limits how long a single resolution may take. If zero, DefaultMaxDuration is used.
+	MaxDuration time.Duration
+	// Logger, if not nil, receives a line for every query sent and every response received.
+	Logger *log.Logger
+	// Transport exchanges queries with name servers. If nil, a UDPTransport is used,
+	// which retries truncated responses over TCP.
+	Transport Transport
+	// Cache, if not nil, holds the answers and referrals received by Lookup and ResolveContext,
+	// and is consulted before any query is sent. It may be shared by several resolvers.
+	Cache *Cache
+	// Prefetch, if true, makes the resolver refresh popular RRsets in the Cache in the background
+	// shortly before their TTL runs out, so that they rarely have to be resolved while a caller waits.
+	Prefetch bool
+
+	// mu guards primed and flights.
+	mu sync.Mutex
+	// primed holds the root server addresses found by Prime, if it has succeeded.
+	primed []netip.Addr
+	// flights holds the resolutions in progress for Lookup, by question.
+	flights map[cacheKey]*flight
+	// nextRoot is the index in the root hints to start the next resolution from.
+	nextRoot atomic.Uint32
+	// infra records how the name servers queried by the resolver have performed.
+	infra infraCache
+}
+
+// DefaultResolver is the Resolver used by the package-level functions, such as Resolve and SendQuery.
+var DefaultResolver = &Resolver{Retries: 2, Cache: NewCache(DefaultCacheSize)}
+
+func (r *Resolver) port() uint16 {
+	if r.Port == 0 {
+		return DefaultPort
+	}
+	return r.Port
+}
+
+func (r *Resolver) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return r.Timeout
+}
+
+func (r *Resolver) retryBackoff() time.Duration {
+	if r.RetryBackoff <= 0 {
+		return DefaultRetryBackoff
+	}
+	return r.RetryBackoff
+}
+
+func (r *Resolver) maxDepth() int {
+	if r.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return r.MaxDepth
+}
+
+func (r *Resolver) transport() Transport {
+	if r.Transport == nil {
+		return &UDPTransport{Timeout: r.timeout()}
+	}
+	return r.Transport
+}
+
+func (r *Resolver) logf(format string, v ...any) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, v...)
+	}
+}
+
 func BuildQuery(queryID int, domainName string, recordType string) []byte {
 	recType := RecordTypes[recordType]
 	header := Header{
@@ -33,74 +149,248 @@ func BuildQuery(queryID int, domainName string, recordType string) []byte {
 	return append(header.ToBytes(), question.ToBytes()...)
 }
 
-// RandomID returns a random 16-bit integer.
+// RandomID returns a random 16-bit integer from a cryptographically secure source,
+// so that off-path attackers cannot predict the ID of a query in order to spoof its response.
 func RandomID() int {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return r.Intn(65535)
+	return int(binary.BigEndian.Uint16(randomBytes(2)))
+}
+
+// randomPort returns a random port number outside of the well known ports.
+func randomPort() int {
+	return 1024 + int(binary.BigEndian.Uint16(randomBytes(2)))%(65536-1024)
+}
+
+// randomBytes returns n bytes read from crypto/rand.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails when the operating system cannot provide randomness at all,
+		// in which case there is no safe way to continue.
+		panic(err)
+	}
+	return b
 }
 
 // SendQuery sends a query to a given DNS resolver, and returns the message from the resolver.
-func SendQuery(ipAddress string, domain string, recordType string) Message {
-	con, err := net.Dial("udp", fmt.Sprintf("%s:53", ipAddress))
+// It is equivalent to SendQueryContext with a background context.
+func SendQuery(ipAddress string, domain string, recordType string) (Message, error) {
+	return SendQueryContext(context.Background(), ipAddress, domain, recordType)
+}
+
+// SendQueryContext sends a query to a given DNS resolver, and returns the message from the resolver.
+// The query advertises a UDP payload size of DefaultUDPSize using EDNS.
+//
+// The query is sent using the transport of DefaultResolver and must complete within its timeout,
+// and it is abandoned as soon as the context is cancelled or its deadline passes.
+func SendQueryContext(ctx context.Context, ipAddress string, domain string, recordType string) (Message, error) {
+	server, err := netip.ParseAddr(ipAddress)
 	if err != nil {
-		log.Fatal(err)
+		return Message{}, fmt.Errorf("dns: bad name server address: %w", err)
 	}
-	defer con.Close()
+	response, _, err := DefaultResolver.query(ctx, server, domain, recordType)
+	return response, err
+}
 
-	query := BuildQuery(RandomID(), domain, recordType)
-	_, _ = con.Write(query)
-	response := make([]byte, 1024)
-	_, err = con.Read(response)
+// query sends a query for the domain name and record type to the name server at the given address,
+// and returns its response, along with its bytes as received if the transport is a RawTransport.
+func (r *Resolver) query(ctx context.Context, server netip.Addr, domain string, recordType string) (Message, []byte, error) {
+	recType, ok := RecordTypes[recordType]
+	if !ok {
+		return Message{}, nil, fmt.Errorf("%w: %s", ErrUnknownType, recordType)
+	}
+	query := NewQuery(uint16(RandomID()), domain, recType.Value)
+	query.SetEDNS(DefaultUDPSize, false)
+	r.logf("query %s %s @%s", domain, recordType, server)
+	response, raw, err := r.exchange(ctx, server, query)
 	if err != nil {
-		log.Fatal(err)
+		r.logf("query %s %s @%s: %v", domain, recordType, server, err)
+		return Message{}, nil, err
+	}
+	// Name servers that do not implement EDNS respond with FORMERR and no OPT record,
+	// in which case the query is repeated without it, as described in RFC 6891 section 7.
+	if response.Rcode() == RcodeFormatError && response.EDNS == nil {
+		query.EDNS = nil
+		r.logf("query %s %s @%s without EDNS", domain, recordType, server)
+		if response, raw, err = r.exchange(ctx, server, query); err != nil {
+			r.logf("query %s %s @%s: %v", domain, recordType, server, err)
+			return Message{}, nil, err
+		}
 	}
-	// _ = os.WriteFile("./response", response, 0644)
-	return ParseMessage(response)
+	r.logf("response %s %s @%s: %s, %d answers, %d authorities, %d additionals", domain, recordType, server,
+		response.Rcode(), len(response.Answers), len(response.Authorities), len(response.Additionals))
+	return response, raw, nil
 }
 
-// AsciiResolve recursively queries nameservers to find the IP address for a given domain name.
-// It also prints ascii art of each resolution step.
-func AsciiResolve(domainName string, recordType string, impatient bool) []byte {
-	nameserver := rootNameserver
-	for {
-		dino.NewDino().SayRight(fmt.Sprintf("Hey %s what's the address for %s?", nameserver, domainName))
+// exchange sends a query to the name server at the given address using the transport of the resolver.
+// The bytes of the response are only returned if the transport is a RawTransport, and are nil otherwise.
+func (r *Resolver) exchange(ctx context.Context, server netip.Addr, query Message) (Message, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+	address := netip.AddrPortFrom(server, r.port())
+	if transport, ok := r.transport().(RawTransport); ok {
+		return transport.ExchangeRaw(ctx, address, query)
+	}
+	response, err := r.transport().Exchange(ctx, address, query)
+	return response, nil, err
+}
+
+// checkResponse returns a *ResponseError if the response from server neither answers the
+// question, nor refers to other name servers that might be able to answer it.
+func checkResponse(server string, response Message) error {
+	rcode := response.Rcode()
+	err, failed := rcodeErrors[rcode]
+	if rcode != RcodeSuccess && !failed {
+		err, failed = ErrUnexpectedRcode, true
+	}
+	if !failed {
+		if chain, answers := followAliases(response); len(answers) > 0 || len(chain) > 0 || isReferral(response) {
+			return nil
+		}
+	}
+	if !failed {
+		err = ErrNoData
+	}
+
+	responseErr := &ResponseError{Server: server, Rcode: rcode, SOA: GetSOA(response), Err: err}
+	if len(response.Questions) > 0 {
+		responseErr.Name = string(response.Questions[0].Name)
+		responseErr.Type = response.Questions[0].Type
+	}
+	return responseErr
+}
+
+// followAliases follows the chain of CNAME records in the answer section of a response, starting
+// from the queried name, as described in [RFC 1034 section 3.6.2]. It returns the CNAME records of
+// the chain in order, and the records of the queried type owned by the name at the end of the chain,
+// if the response holds any. A query for CNAME records is answered by the CNAME record itself.
+//
+// [RFC 1034 section 3.6.2]: https://datatracker.ietf.org/doc/html/rfc1034#section-3.6.2
+func followAliases(response Message) (chain []Record, answers []Record) {
+	if len(response.Questions) == 0 {
+		return nil, nil
+	}
+	question := response.Questions[0]
+	name := string(question.Name)
+	// Every step uses up an answer record, so a chain that is longer than the answer section has looped.
+	for len(chain) <= len(response.Answers) {
+		owned := FilterByName(response.Answers, name)
+		if answers := FilterByType(owned, question.Type); len(answers) > 0 {
+			return chain, answers
+		}
+		cnames := FilterByType(owned, TypeCNAME)
+		if len(cnames) == 0 {
+			break
+		}
+		cname, ok := cnames[0].Data.(*CNAME)
+		if !ok {
+			break
+		}
+		chain = append(chain, cnames[0])
+		name = cname.Target
+	}
+	return chain, nil
+}
+
+// followZoneAliases works like followAliases, but only returns the records that the name servers
+// of the zone are responsible for. The chain stops at the first alias owned by a name outside
+// the zone, and answers owned by a name outside the zone are left out, so that the target of
+// the chain is resolved from its own name servers rather than trusted.
+func followZoneAliases(response Message, zone string) (chain []Record, answers []Record) {
+	chain, answers = followAliases(response)
+	for i, alias := range chain {
+		if !isSubdomain(string(alias.Name), zone) {
+			return chain[:i], nil
+		}
+	}
+	if len(answers) > 0 && !isSubdomain(string(answers[0].Name), zone) {
+		return chain, nil
+	}
+	return chain, answers
+}
+
+// aliasTarget returns the name that the last alias of a chain points to.
+func aliasTarget(chain []Record) string {
+	return chain[len(chain)-1].Data.(*CNAME).Target
+}
+
+// isReferral reports whether the response delegates the question to other name servers,
+// rather than being an authoritative statement that the name has no matching records.
+func isReferral(response Message) bool {
+	return !response.Header.AA() && GetNameserver(response) != ""
+}
+
+// referralZone returns the zone that a referral delegates, which owns its first NS record,
+// in canonical form.
+func referralZone(referral Message) string {
+	ns := FilterByType(referral.Authorities, TypeNS)
+	if len(ns) == 0 {
+		return ""
+	}
+	return canonicalName(string(ns[0].Name))
+}
+
+// checkReferral returns an error matching ErrBadReferral unless a referral from a name server of
+// the zone delegates a zone strictly below it that encloses the question. Otherwise any name server
+// on the way could take over zones it is not responsible for, such as a whole top-level domain.
+func checkReferral(server string, referral Message, zone string) error {
+	delegated := referralZone(referral)
+	if delegated != canonicalName(zone) && isSubdomain(delegated, zone) && len(referral.Questions) > 0 &&
+		isSubdomain(string(referral.Questions[0].Name), delegated) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s referred to %q from %q", ErrBadReferral, server, delegated, canonicalName(zone))
+}
+
+// AsciiResolve recursively queries nameservers to find the IP addresses for a given domain name
+// using DefaultResolver. It also prints ascii art of each resolution step.
+func AsciiResolve(domainName string, recordType string, impatient bool) ([]netip.Addr, error) {
+	return DefaultResolver.AsciiResolve(domainName, recordType, impatient)
+}
+
+// AsciiResolve recursively queries nameservers to find the IP addresses for a given domain name,
+// like Resolve. It then prints ascii art of each step of the trace of the resolution, waiting for
+// a keypress between steps unless impatient is true.
+func (r *Resolver) AsciiResolve(domainName string, recordType string, impatient bool) ([]netip.Addr, error) {
+	ips, trace, err := r.ResolveTrace(context.Background(), domainName, recordType)
+	pause := func() {
 		if !impatient {
 			waitForKeypress()
 		}
-		response := SendQuery(nameserver, domainName, recordType)
-		if ip := GetAnswer(response); ip != nil {
-			dino.NewServer(nameserver).SayLeft(fmt.Sprintf("The IP address is %s", ip))
-			if !impatient {
-				waitForKeypress()
-			}
-			return ip
-		} else if alias := GetAlias(response); alias != "" {
-			dino.NewServer(nameserver).SayLeft(fmt.Sprintf("That's an alias for %s", alias))
-			if !impatient {
-				waitForKeypress()
-			}
-			return AsciiResolve(alias, "A", impatient)
-		} else if nsIP := GetNameserverIP(response); nsIP != nil {
-			dino.NewServer(nameserver).SayLeft(fmt.Sprintf("I don't know, you should ask %s", nsIP))
-			if !impatient {
-				waitForKeypress()
+	}
+	for i, step := range trace.Steps {
+		dino.NewDino().SayRight(fmt.Sprintf("Hey %s what's the address for %s?", step.Server, step.Name))
+		pause()
+		server := dino.NewServer(step.Server.String())
+		switch step.Decision {
+		case DecisionAnswer:
+			_, answers := followZoneAliases(step.Response, step.Zone)
+			message := fmt.Sprintf("The answer is %s", answers[0].Data)
+			if ips := recordAddrs(answers); len(ips) == 1 {
+				message = fmt.Sprintf("The IP address is %s", ips[0])
+			} else if len(ips) > 1 {
+				message = fmt.Sprintf("The IP addresses are %s", joinAddrs(ips))
 			}
-			nameserver = string(nsIP)
-		} else if nsDomain := GetNameserver(response); nsDomain != "" {
-			dino.NewServer(nameserver).SayLeft(fmt.Sprintf("I don't know, you should ask %s", nsDomain))
-			if !impatient {
-				waitForKeypress()
+			server.SayLeft(message)
+		case DecisionAlias:
+			chain, _ := followZoneAliases(step.Response, step.Zone)
+			server.SayLeft(fmt.Sprintf("That's an alias for %s", aliasTarget(chain)))
+		case DecisionReferral:
+			server.SayLeft(fmt.Sprintf("I don't know, you should ask %s", referralServers(step.Response)[0].addr))
+		case DecisionGluelessReferral:
+			// The name server resolved next is the one the resolver picked, which the nested step names.
+			nsDomain := GetNameserver(step.Response)
+			if i+1 < len(trace.Steps) && trace.Steps[i+1].Depth == step.Depth+1 {
+				nsDomain = trace.Steps[i+1].Name
 			}
+			server.SayLeft(fmt.Sprintf("I don't know, you should ask %s", nsDomain))
+			pause()
 			dino.NewDino().SayLeft(fmt.Sprintf("I wonder how I can reach %s", nsDomain))
-			if !impatient {
-				waitForKeypress()
-			}
-			nameserver = string(AsciiResolve(nsDomain, "A", impatient))
-		} else {
-			panic("something went wrong")
+		default:
+			server.SayLeft(fmt.Sprintf("Sorry, I can't help you with that: %v", step.Err))
 		}
+		pause()
 	}
-	return nil
+	return ips, err
 }
 
 func waitForKeypress() {
@@ -108,22 +398,360 @@ func waitForKeypress() {
 	_, _ = fmt.Scanln()
 }
 
-// Resolve recursively queries nameservers to find the IP address for a given domain name.
-func Resolve(domainName string, recordType string) []byte {
-	nameserver := rootNameserver
+// Resolve recursively queries nameservers to find the IP addresses for a given domain name
+// using DefaultResolver. It is equivalent to ResolveContext with a background context.
+func Resolve(domainName string, recordType string) ([]netip.Addr, error) {
+	return DefaultResolver.Resolve(domainName, recordType)
+}
+
+// ResolveContext recursively queries nameservers to find the IP addresses for a given domain name
+// using DefaultResolver.
+func ResolveContext(ctx context.Context, domainName string, recordType string) ([]netip.Addr, error) {
+	return DefaultResolver.ResolveContext(ctx, domainName, recordType)
+}
+
+// ResolveTrace recursively queries nameservers to find the IP addresses for a given domain name
+// using DefaultResolver, and returns the trace of the resolution.
+func ResolveTrace(ctx context.Context, domainName string, recordType string) ([]netip.Addr, Trace, error) {
+	return DefaultResolver.ResolveTrace(ctx, domainName, recordType)
+}
+
+// Lookup recursively queries nameservers for the records of a given type owned by a domain name
+// using DefaultResolver.
+func Lookup(ctx context.Context, domainName string, recordType string) ([]Record, error) {
+	return DefaultResolver.Lookup(ctx, domainName, recordType)
+}
+
+// Resolve recursively queries nameservers to find the IP addresses for a given domain name.
+// It is equivalent to ResolveContext with a background context.
+func (r *Resolver) Resolve(domainName string, recordType string) ([]netip.Addr, error) {
+	return r.ResolveContext(context.Background(), domainName, recordType)
+}
+
+// ResolveContext recursively queries nameservers to find the IP addresses for a given domain name,
+// which are held by its records of recordType "A" or "AAAA". It returns every address of the name,
+// in the order the name server gave them, and works like Lookup in every other respect.
+func (r *Resolver) ResolveContext(ctx context.Context, domainName string, recordType string) ([]netip.Addr, error) {
+	records, err := r.Lookup(ctx, domainName, recordType)
+	if err != nil {
+		return nil, err
+	}
+	return recordAddrs(records), nil
+}
+
+// ResolveTrace works like ResolveContext, and also returns the trace of the resolution: every query
+// that was sent, the response to it and what the resolver made of it. The trace is returned even
+// if the resolution fails. Unlike ResolveContext, a traced resolution is never shared with other
+// lookups of the same name.
+func (r *Resolver) ResolveTrace(ctx context.Context, domainName string, recordType string) ([]netip.Addr, Trace, error) {
+	ctx, cancel, convert := r.withDuration(ctx)
+	defer cancel()
+	b := r.newBudget()
+	b.trace = &Trace{}
+	records, err := r.lookup(ctx, domainName, recordType, b, 0)
+	if err != nil {
+		return nil, *b.trace, convert(domainName, err)
+	}
+	return recordAddrs(records), *b.trace, nil
+}
+
+// Lookup recursively queries nameservers for the records of a given type, such as "MX", owned by a
+// domain name, starting from the root servers. It returns the complete RRset from the answer, with
+// the TTL of each record as given by the authoritative name server.
+// The lookup returns as soon as the context is cancelled or its deadline passes.
+//
+// If the name is an alias, the chain of CNAME records is followed to the canonical name, and the
+// returned records start with the CNAME records of the chain, in order, followed by the RRset of
+// the canonical name. Aliases whose targets are included in the same response are followed without
+// further queries. Chains that loop or are longer than 8 aliases fail with ErrCNAMELoop.
+//
+// Every name server named in a referral is tried in turn until one of them responds, and the whole
+// list is retried up to Retries times before giving up on the referral. Name servers that have
+// responded quickly to earlier queries are tried first, while those that have stopped responding,
+// or refused to answer, are tried last for a while.
+//
+// If the resolver has a Cache, answers are returned from it with their remaining TTL for as long as
+// they are cached, and resolution starts at the name servers of the closest zone it knows about.
+// Names that do not exist, and names without records of the requested type, are cached as well,
+// and fail with the same *ResponseError until their negative TTL runs out. If the name servers
+// cannot be reached, or do not answer within the budget, answers that expired less than the
+// MaxStale of the Cache ago are returned instead, with a TTL of 30 seconds.
+//
+// Each resolution has a budget: it may send at most MaxQueries queries and take at most MaxDuration,
+// and resolving the address of a name server without glue nests it one level deeper, up to MaxDepth
+// levels. Resolutions that run out of budget fail with an error matching ErrBudgetExceeded,
+// which also matches ErrMaxDepth if they were nested too deeply.
+//
+// Concurrent lookups of the same name, type and class share a single resolution, and each of them
+// receives its result. A lookup whose context is done stops waiting and returns the error of the
+// context, while the resolution carries on for the lookups still waiting for it.
+//
+// If the name cannot be resolved because of a response from a name server, the returned error
+// is a *ResponseError, which can be matched against ErrNXDomain, ErrNoData and the other RCODE errors.
+func (r *Resolver) Lookup(ctx context.Context, domainName string, recordType string) ([]Record, error) {
+	return r.shareLookup(ctx, domainName, recordType)
+}
+
+// lookup looks up the records of the domain name at the given depth of nesting,
+// spending queries from the budget of the resolution.
+func (r *Resolver) lookup(ctx context.Context, domainName string, recordType string, b *budget, depth int) ([]Record, error) {
+	if err := b.enter(domainName, depth); err != nil {
+		return nil, err
+	}
+	recType, ok := RecordTypes[recordType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, recordType)
+	}
+	var aliases []Record
+	seen := map[string]bool{canonicalName(domainName): true}
+	name := domainName
+	servers, zone := r.startServers(name)
 	for {
-		response := SendQuery(nameserver, domainName, recordType)
-		if ip := GetAnswer(response); ip != nil {
-			return ip
-		} else if alias := GetAlias(response); alias != "" {
-			return Resolve(alias, "A")
-		} else if nsIP := GetNameserverIP(response); nsIP != nil {
-			nameserver = string(nsIP)
-		} else if nsDomain := GetNameserver(response); nsDomain != "" {
-			nameserver = string(Resolve(nsDomain, "A"))
-		} else {
-			panic("something went wrong")
-		}
-	}
-	return nil
+		var chain, answers []Record
+		if !b.refresh || depth > 0 {
+			var prefetch bool
+			var err error
+			chain, answers, prefetch, err = r.Cache.answer(name, recType.Value, false)
+			if err != nil {
+				return nil, err
+			}
+			if prefetch && r.Prefetch {
+				go r.prefetch(name, recordType)
+			}
+		}
+		if len(chain) == 0 && len(answers) == 0 {
+			response, err := r.queryServers(ctx, servers, zone, name, recordType, b, depth)
+			if err != nil {
+				r.Cache.storeNegative(response, err, zone)
+				if !canServeStale(err) {
+					return nil, err
+				}
+				var staleErr error
+				if chain, answers, _, staleErr = r.Cache.answer(name, recType.Value, true); staleErr != nil {
+					return nil, staleErr
+				}
+				if len(chain) == 0 && len(answers) == 0 {
+					return nil, err
+				}
+				r.logf("serving stale %s %s: %v", name, recordType, err)
+			} else {
+				r.Cache.storeResponse(response, zone)
+				if chain, answers = followZoneAliases(response, zone); len(chain) == 0 && len(answers) == 0 {
+					servers, zone = referralServers(response), referralZone(response)
+					continue
+				}
+			}
+		}
+		for _, alias := range chain {
+			target := canonicalName(alias.Data.(*CNAME).Target)
+			if seen[target] || len(aliases) == maxCNAMEChain {
+				return nil, fmt.Errorf("%w resolving %s", ErrCNAMELoop, domainName)
+			}
+			seen[target] = true
+			aliases = append(aliases, alias)
+		}
+		if len(answers) > 0 {
+			return append(aliases, answers...), nil
+		}
+		// There are no records for the target of the alias, which may well be in another zone,
+		// so the target is resolved from the closest name servers known for it.
+		name = aliasTarget(chain)
+		servers, zone = r.startServers(name)
+	}
+}
+
+// prefetch resolves a question again, bypassing the cached answer, so that the cache is refreshed
+// before the answer expires.
+func (r *Resolver) prefetch(domainName string, recordType string) {
+	ctx, cancel, convert := r.withDuration(context.Background())
+	defer cancel()
+	b := r.newBudget()
+	b.refresh = true
+	if _, err := r.lookup(ctx, domainName, recordType, b, 0); err != nil {
+		r.logf("prefetch %s %s: %v", domainName, recordType, convert(domainName, err))
+		return
+	}
+	r.logf("prefetched %s %s", domainName, recordType)
+}
+
+// canServeStale reports whether a resolution that failed with the error may be answered from
+// cache entries whose TTL has run out, as described in [RFC 8767 section 5]: when the name servers
+// could not be reached or did not answer in time, but not when they answered.
+//
+// [RFC 8767 section 5]: https://datatracker.ietf.org/doc/html/rfc8767#section-5
+func canServeStale(err error) bool {
+	return errors.Is(err, ErrServersFailed) || errors.Is(err, ErrBudgetExceeded) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// startServers returns the name servers to start resolving a domain name from, along with the
+// zone they serve: those of the closest enclosing zone in the cache, or else the root servers.
+func (r *Resolver) startServers(domainName string) ([]nameserver, string) {
+	if servers, zone := r.Cache.delegation(domainName); len(servers) > 0 {
+		return servers, zone
+	}
+	return r.roots(), ""
+}
+
+// recordAddrs returns the addresses held by the A and AAAA records among the records.
+func recordAddrs(records []Record) []netip.Addr {
+	var ips []netip.Addr
+	for _, record := range records {
+		if ip := recordAddr(record); ip.IsValid() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// joinAddrs formats a list of addresses for printing, separated by commas.
+func joinAddrs(ips []netip.Addr) string {
+	parts := make([]string, len(ips))
+	for i, ip := range ips {
+		parts[i] = ip.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// nameserver is a name server that a query can be sent to.
+type nameserver struct {
+	// name is the host name of the server, if known.
+	name string
+	// addr is the address of the server. It is invalid when a referral did not include
+	// glue for the server, in which case the address must be resolved from the name.
+	addr netip.Addr
+}
+
+// referralServers returns every name server from the authority section of a referral.
+// Servers with IPv4 glue come first, then servers with IPv6 glue, followed by servers
+// without any glue, each in the order of their NS records.
+func referralServers(response Message) []nameserver {
+	var ipv4, ipv6, glueless []nameserver
+	for _, authority := range response.Authorities {
+		ns, ok := authority.Data.(*NS)
+		if !ok {
+			continue
+		}
+		glued := false
+		for _, glue := range FilterByName(response.Additionals, ns.Host) {
+			ip := recordAddr(glue)
+			if ip.Is4() {
+				ipv4 = append(ipv4, nameserver{name: ns.Host, addr: ip})
+			} else if ip.Is6() {
+				ipv6 = append(ipv6, nameserver{name: ns.Host, addr: ip})
+			} else {
+				continue
+			}
+			glued = true
+		}
+		if !glued {
+			glueless = append(glueless, nameserver{name: ns.Host})
+		}
+	}
+	return append(append(ipv4, ipv6...), glueless...)
+}
+
+// queryServers sends the query to each server in turn, and returns the first response that either
+// answers the question or refers to other name servers. The servers are tried in the order chosen
+// by the infrastructure cache of the resolver, which prefers those that have responded quickly and
+// records the round-trip time, or the failure, of every query. Responses that only report a problem
+// with the server, such as SERVFAIL or REFUSED, are treated like unreachable servers and the next
+// server is tried, as are referrals to zones that are not below the zone the servers were delegated.
+// Such servers are avoided for that zone only. The list is retried up to r.Retries times, waiting
+// the retry backoff before the first retry and twice as long before each one after that.
+//
+// The address of a server without glue is only resolved once every server before it has failed,
+// from its A records, or from its AAAA records if it has no A records.
+// Response errors such as NXDOMAIN are returned along with the response they came from.
+// Every query is spent from the budget, and no further servers are tried once it has run out.
+func (r *Resolver) queryServers(ctx context.Context, servers []nameserver, zone string, domainName string, recordType string, b *budget, depth int) (Message, error) {
+	servers = r.infra.order(servers, zone)
+	var errs []error
+	backoff := r.retryBackoff()
+	for attempt := 0; attempt <= r.Retries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, backoff); err != nil {
+				return Message{}, err
+			}
+			backoff *= 2
+		}
+		for i := 0; i < len(servers); i++ {
+			if !servers[i].addr.IsValid() {
+				// Replace the glueless server with each of its resolved addresses.
+				records, err := r.lookup(ctx, servers[i].name, "A", b, depth+1)
+				ips := recordAddrs(records)
+				if len(ips) == 0 && (err == nil || errors.Is(err, ErrNoData)) && ctx.Err() == nil && !b.exhausted() {
+					// The name server may only be reachable over IPv6.
+					records, err = r.lookup(ctx, servers[i].name, "AAAA", b, depth+1)
+					ips = recordAddrs(records)
+				}
+				if err == nil && len(ips) == 0 {
+					err = ErrNoData
+				}
+				// If resolving the name server spent the last query, spending the next one below fails.
+				if err != nil && (ctx.Err() != nil || b.exhausted()) {
+					return Message{}, err
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("resolving name server %s: %w", servers[i].name, err))
+					servers = append(servers[:i], servers[i+1:]...)
+					i--
+					continue
+				}
+				resolved := make([]nameserver, len(ips))
+				for j, ip := range ips {
+					resolved[j] = nameserver{name: servers[i].name, addr: ip}
+				}
+				servers = append(servers[:i], append(resolved, servers[i+1:]...)...)
+			}
+
+			if err := b.spend(domainName); err != nil {
+				return Message{}, err
+			}
+			server := servers[i].addr
+			start := time.Now()
+			response, raw, err := r.query(ctx, server, domainName, recordType)
+			latency := time.Since(start)
+			responded := err == nil
+			if responded {
+				err = checkResponse(server.String(), response)
+				if chain, answers := followAliases(response); err == nil && len(chain) == 0 && len(answers) == 0 {
+					err = checkReferral(server.String(), response, zone)
+				}
+				r.infra.responded(server, zone, latency, isServerFailure(err))
+			} else if ctx.Err() == nil {
+				r.infra.failed(server, latency)
+			}
+			if b.trace != nil {
+				b.trace.add(traceStep(depth, server, zone, domainName, recordType, response, raw, latency, err))
+			}
+			if responded && !isServerFailure(err) {
+				return response, err
+			}
+			if ctx.Err() != nil {
+				return Message{}, ctx.Err()
+			}
+			errs = append(errs, err)
+		}
+	}
+	return Message{}, fmt.Errorf("%w for %s: %w", ErrServersFailed, domainName, errors.Join(errs...))
+}
+
+// isServerFailure reports whether an error from checkResponse indicates a problem with
+// the name server rather than with the name being queried.
+func isServerFailure(err error) bool {
+	return errors.Is(err, ErrServFail) || errors.Is(err, ErrRefused) || errors.Is(err, ErrNotImp) ||
+		errors.Is(err, ErrFormErr) || errors.Is(err, ErrBadVers) || errors.Is(err, ErrUnexpectedRcode) ||
+		errors.Is(err, ErrBadReferral)
+}
+
+// sleep waits for the given duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
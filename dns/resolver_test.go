@@ -1,8 +1,15 @@
 package dns
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/netip"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_buildQuery(t *testing.T) {
@@ -30,3 +37,444 @@ func Test_buildQuery(t *testing.T) {
 		})
 	}
 }
+
+func Test_checkResponse(t *testing.T) {
+	question := []Question{{Name: []byte("www.example.com"), Type: TypeA, Class: ClassIn}}
+	soa := Record{
+		Name:  []byte("example.com"),
+		Type:  TypeSOA,
+		Class: ClassIn,
+		TTL:   3600,
+		Data:  &SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Minimum: 300},
+	}
+	ns := Record{Name: []byte("com"), Type: TypeNS, Class: ClassIn, Data: &NS{Host: "a.gtld-servers.net"}}
+	answer := Record{Name: []byte("www.example.com"), Type: TypeA, Class: ClassIn, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}}
+	tests := []struct {
+		name      string
+		flags     uint16
+		answers   []Record
+		authority []Record
+		wantErr   error
+		wantSOA   bool
+	}{
+		{name: "answer", flags: 0x8400, answers: []Record{answer}},
+		{name: "referral", flags: 0x8000, authority: []Record{ns}},
+		{name: "NXDOMAIN", flags: 0x8403, authority: []Record{soa}, wantErr: ErrNXDomain, wantSOA: true},
+		{name: "SERVFAIL", flags: 0x8002, wantErr: ErrServFail},
+		{name: "REFUSED", flags: 0x8005, wantErr: ErrRefused},
+		{name: "NOTIMP", flags: 0x8004, wantErr: ErrNotImp},
+		{name: "FORMERR", flags: 0x8001, wantErr: ErrFormErr},
+		{name: "unassigned rcode", flags: 0x800b, wantErr: ErrUnexpectedRcode},
+		{name: "NODATA", flags: 0x8400, authority: []Record{soa}, wantErr: ErrNoData, wantSOA: true},
+		{name: "authoritative NODATA with NS", flags: 0x8400, authority: []Record{ns}, wantErr: ErrNoData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := Message{
+				Header:      Header{Flags: tt.flags},
+				Questions:   question,
+				Answers:     tt.answers,
+				Authorities: tt.authority,
+			}
+			err := checkResponse("192.0.2.53", response)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil {
+				return
+			}
+			var responseErr *ResponseError
+			if !errors.As(err, &responseErr) {
+				t.Fatalf("expected a *ResponseError, got %T", err)
+			}
+			if responseErr.Server != "192.0.2.53" || responseErr.Name != "www.example.com" || responseErr.Type != TypeA {
+				t.Errorf("unexpected error details: %v", responseErr)
+			}
+			if gotSOA := responseErr.SOA != nil; gotSOA != tt.wantSOA {
+				t.Errorf("expected SOA present to be %t, got %v", tt.wantSOA, responseErr.SOA)
+			}
+		})
+	}
+}
+
+func TestSendQueryContext_unknownType(t *testing.T) {
+	_, err := SendQueryContext(context.Background(), "192.0.2.53", "example.com", "BOGUS")
+	if !errors.Is(err, ErrUnknownType) {
+		t.Errorf("expected error %v, got %v", ErrUnknownType, err)
+	}
+}
+
+func Test_referralServers(t *testing.T) {
+	ns := func(host string) Record {
+		return Record{Name: []byte("example.com"), Type: TypeNS, Class: ClassIn, Data: &NS{Host: host}}
+	}
+	glue := func(host string, ip string) Record {
+		addr := netip.MustParseAddr(ip)
+		if addr.Is4() {
+			return Record{Name: []byte(host), Type: TypeA, Class: ClassIn, Data: &A{Addr: addr}}
+		}
+		return Record{Name: []byte(host), Type: TypeAAAA, Class: ClassIn, Data: &AAAA{Addr: addr}}
+	}
+	response := Message{
+		Authorities: []Record{ns("ns1.example.com"), ns("ns2.example.net"), ns("ns3.example.com")},
+		Additionals: []Record{
+			glue("ns3.example.com", "2001:db8::3"),
+			glue("NS1.example.com.", "192.0.2.1"),
+			glue("ns1.example.com", "2001:db8::1"),
+			glue("ns3.example.com", "192.0.2.3"),
+			glue("unrelated.example.com", "192.0.2.99"),
+		},
+	}
+	want := []nameserver{
+		{name: "ns1.example.com", addr: netip.MustParseAddr("192.0.2.1")},
+		{name: "ns3.example.com", addr: netip.MustParseAddr("192.0.2.3")},
+		{name: "ns1.example.com", addr: netip.MustParseAddr("2001:db8::1")},
+		{name: "ns3.example.com", addr: netip.MustParseAddr("2001:db8::3")},
+		{name: "ns2.example.net"},
+	}
+	if got := referralServers(response); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// testRecord returns a record in the Internet class with the type implied by its data.
+func testRecord(name string, data RData) Record {
+	var recordType uint16
+	switch data.(type) {
+	case *A:
+		recordType = TypeA
+	case *NS:
+		recordType = TypeNS
+	case *AAAA:
+		recordType = TypeAAAA
+	case *CNAME:
+		recordType = TypeCNAME
+	case *TXT:
+		recordType = TypeTXT
+	case *SOA:
+		recordType = TypeSOA
+	}
+	return Record{Name: []byte(name), Type: recordType, Class: ClassIn, TTL: 300, Data: data}
+}
+
+// reply returns a handler that answers each query with the message returned by respond,
+// after filling in the ID, question and QR bit of the response.
+func reply(respond func(question Question) Message) Handler {
+	return func(ctx context.Context, query Message) (Message, error) {
+		response := respond(query.Questions[0])
+		response.Header.ID = query.Header.ID
+		response.Header.SetQR(true)
+		response.Questions = query.Questions
+		return response, nil
+	}
+}
+
+// exampleZone holds the records served by the authoritative server of fakeHierarchy.
+var exampleZone = []Record{
+	testRecord("www.example.com", &A{Addr: netip.MustParseAddr("203.0.113.1")}),
+	testRecord("www.example.com", &A{Addr: netip.MustParseAddr("203.0.113.2")}),
+	testRecord("www.example.com", &TXT{Text: []string{"hello"}}),
+	testRecord("ns.example.net", &A{Addr: netip.MustParseAddr("192.0.2.3")}),
+	testRecord("alias.example.com", &CNAME{Target: "www.example.com"}),
+	testRecord("other.example.com", &CNAME{Target: "host.example.net"}),
+	testRecord("host.example.net", &AAAA{Addr: netip.MustParseAddr("2001:db8::1")}),
+	testRecord("loop1.example.com", &CNAME{Target: "loop2.example.com"}),
+	testRecord("loop2.example.com", &CNAME{Target: "loop1.example.com"}),
+	testRecord("far1.example.com", &CNAME{Target: "far1.example.net"}),
+	testRecord("far1.example.net", &CNAME{Target: "far2.example.com"}),
+	testRecord("far2.example.com", &CNAME{Target: "far1.example.com"}),
+}
+
+// fakeHierarchy returns a Resolver whose transport delivers queries to a fake root server at 192.0.2.1,
+// a server for the com and net zones at 192.0.2.2, and a server for the example.com and example.net zones
+// at 192.0.2.3. The example.com zone is delegated to ns.example.net without glue.
+func fakeHierarchy() *Resolver {
+	addr := func(ip string) *A { return &A{Addr: netip.MustParseAddr(ip)} }
+	server := func(ip string) netip.AddrPort { return netip.AddrPortFrom(netip.MustParseAddr(ip), DefaultPort) }
+	transport := &MemoryTransport{Servers: map[netip.AddrPort]Handler{
+		server("192.0.2.1"): reply(func(question Question) Message {
+			tld := string(question.Name)[strings.LastIndex(string(question.Name), ".")+1:]
+			return Message{
+				Authorities: []Record{testRecord(tld, &NS{Host: "ns.nic." + tld})},
+				Additionals: []Record{testRecord("ns.nic."+tld, addr("192.0.2.2"))},
+			}
+		}),
+		server("192.0.2.2"): reply(func(question Question) Message {
+			if name := string(question.Name); strings.HasSuffix(name, ".test") {
+				// a.test and b.test are delegated to name servers inside each other without glue,
+				// so resolving a name in either of them never ends.
+				zone, other := "a.test", "b.test"
+				if strings.HasSuffix(name, "b.test") {
+					zone, other = other, zone
+				}
+				return Message{Authorities: []Record{testRecord(zone, &NS{Host: "ns." + other})}}
+			}
+			if strings.HasSuffix(string(question.Name), ".net") {
+				return Message{
+					Authorities: []Record{testRecord("example.net", &NS{Host: "ns.example.net"})},
+					Additionals: []Record{testRecord("ns.example.net", addr("192.0.2.3"))},
+				}
+			}
+			return Message{Authorities: []Record{testRecord("example.com", &NS{Host: "ns.example.net"})}}
+		}),
+		server("192.0.2.3"): reply(func(question Question) Message {
+			var response Message
+			response.Header.SetAA(true)
+			zone := string(question.Name)[strings.Index(string(question.Name), ".")+1:]
+			// Negative answers carry the SOA record of the zone, whose MINIMUM field is lower than its TTL.
+			soa := testRecord(zone, &SOA{MName: "ns.example.net", RName: "hostmaster." + zone, Minimum: 60})
+			if len(FilterByName(exampleZone, string(question.Name))) == 0 {
+				response.SetRcode(RcodeNameError)
+				response.Authorities = []Record{soa}
+				return response
+			}
+			// Follow aliases within the zone of the question, like an authoritative server does.
+			for name := string(question.Name); strings.HasSuffix(name, zone) && len(response.Answers) < 20; {
+				owned := FilterByName(exampleZone, name)
+				if answers := FilterByType(owned, question.Type); len(answers) > 0 {
+					response.Answers = append(response.Answers, answers...)
+					break
+				}
+				cnames := FilterByType(owned, TypeCNAME)
+				if len(cnames) == 0 {
+					break
+				}
+				response.Answers = append(response.Answers, cnames[0])
+				name = cnames[0].Data.(*CNAME).Target
+			}
+			if len(response.Answers) == 0 {
+				response.Authorities = []Record{soa}
+			}
+			return response
+		}),
+	}}
+	return &Resolver{
+		RootHints: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		Transport: transport,
+	}
+}
+
+func TestResolver_ResolveContext(t *testing.T) {
+	resolver := fakeHierarchy()
+	var logs bytes.Buffer
+	resolver.Logger = log.New(&logs, "", 0)
+
+	ips, err := resolver.ResolveContext(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("203.0.113.1"), netip.MustParseAddr("203.0.113.2")}
+	if !reflect.DeepEqual(ips, want) {
+		t.Errorf("expected %v, got %v", want, ips)
+	}
+	if want := "query ns.example.net A @192.0.2.2"; !strings.Contains(logs.String(), want) {
+		t.Errorf("expected the log to contain %q, got:\n%s", want, logs.String())
+	}
+
+	_, err = resolver.ResolveContext(context.Background(), "missing.example.com", "A")
+	if !errors.Is(err, ErrNXDomain) {
+		t.Errorf("expected error %v, got %v", ErrNXDomain, err)
+	}
+}
+
+func TestResolver_Lookup(t *testing.T) {
+	resolver := fakeHierarchy()
+	records, err := resolver.Lookup(context.Background(), "www.example.com", "TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FilterByType(FilterByName(exampleZone, "www.example.com"), TypeTXT)
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("expected %v, got %v", want, records)
+	}
+
+	records, err = resolver.Lookup(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].TTL != 300 || records[1].TTL != 300 {
+		t.Errorf("expected both A records with their TTL, got %v", records)
+	}
+}
+
+func TestResolver_Lookup_aliases(t *testing.T) {
+	resolver := fakeHierarchy()
+	alias := func(name, target string) Record { return testRecord(name, &CNAME{Target: target}) }
+	tests := []struct {
+		name       string
+		domainName string
+		recordType string
+		want       []Record
+		wantErr    error
+	}{
+		{
+			name:       "target in the same answer",
+			domainName: "alias.example.com",
+			recordType: "TXT",
+			want: []Record{
+				alias("alias.example.com", "www.example.com"),
+				testRecord("www.example.com", &TXT{Text: []string{"hello"}}),
+			},
+		},
+		{
+			name:       "target in another zone",
+			domainName: "other.example.com",
+			recordType: "AAAA",
+			want: []Record{
+				alias("other.example.com", "host.example.net"),
+				testRecord("host.example.net", &AAAA{Addr: netip.MustParseAddr("2001:db8::1")}),
+			},
+		},
+		{
+			name:       "querying the alias itself",
+			domainName: "alias.example.com",
+			recordType: "CNAME",
+			want:       []Record{alias("alias.example.com", "www.example.com")},
+		},
+		{
+			name:       "loop in the same answer",
+			domainName: "loop1.example.com",
+			recordType: "A",
+			wantErr:    ErrCNAMELoop,
+		},
+		{
+			name:       "loop across zones",
+			domainName: "far1.example.com",
+			recordType: "A",
+			wantErr:    ErrCNAMELoop,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolver.Lookup(context.Background(), tt.domainName, tt.recordType)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResolver_ResolveContext_maxDepth(t *testing.T) {
+	// Resolving the glueless name server of example.com nests one level deeper.
+	resolver := fakeHierarchy()
+	resolver.MaxDepth = 1
+	if _, err := resolver.ResolveContext(context.Background(), "www.example.com", "A"); err != nil {
+		t.Errorf("expected a depth of 1 to be enough, got %v", err)
+	}
+}
+
+func TestResolver_queryServers(t *testing.T) {
+	server := func(ip string) netip.AddrPort { return netip.AddrPortFrom(netip.MustParseAddr(ip), DefaultPort) }
+	rcode := func(rcode Rcode) func(Question) Message {
+		return func(Question) Message {
+			var response Message
+			response.SetRcode(rcode)
+			return response
+		}
+	}
+	answer := func(question Question) Message {
+		return Message{Answers: []Record{testRecord(string(question.Name), &A{Addr: netip.MustParseAddr("203.0.113.1")})}}
+	}
+	unresponsive := func(ctx context.Context, query Message) (Message, error) {
+		return Message{}, context.DeadlineExceeded
+	}
+
+	tests := []struct {
+		name      string
+		servers   []string
+		wantCount map[string]int
+		wantErrs  []error
+		wantWait  time.Duration
+	}{
+		{
+			name:      "later server answers",
+			servers:   []string{"192.0.2.10", "192.0.2.11", "192.0.2.13"},
+			wantCount: map[string]int{"192.0.2.10": 1, "192.0.2.11": 1, "192.0.2.13": 1},
+		},
+		{
+			name:      "every server fails",
+			servers:   []string{"192.0.2.10", "192.0.2.11", "192.0.2.12"},
+			wantCount: map[string]int{"192.0.2.10": 3, "192.0.2.11": 3, "192.0.2.12": 3},
+			wantErrs:  []error{ErrServersFailed, ErrServFail, ErrRefused, context.DeadlineExceeded},
+			// The list is retried twice, waiting 10ms and then 20ms.
+			wantWait: 30 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &Resolver{
+				Retries:      2,
+				RetryBackoff: 10 * time.Millisecond,
+				Transport: &MemoryTransport{Servers: map[netip.AddrPort]Handler{
+					server("192.0.2.10"): reply(rcode(RcodeServerFailure)),
+					server("192.0.2.11"): unresponsive,
+					server("192.0.2.12"): reply(rcode(RcodeRefused)),
+					server("192.0.2.13"): reply(answer),
+				}},
+			}
+			resolver.infra.intn = func(n int) int { return n - 1 }
+			counts := countQueries(resolver)
+			var servers []nameserver
+			for _, ip := range tt.servers {
+				servers = append(servers, nameserver{addr: netip.MustParseAddr(ip)})
+			}
+
+			start := time.Now()
+			_, err := resolver.queryServers(context.Background(), servers, "example.com", "www.example.com", "A", resolver.newBudget(), 0)
+			for _, want := range tt.wantErrs {
+				if !errors.Is(err, want) {
+					t.Errorf("expected error matching %v, got %v", want, err)
+				}
+			}
+			if tt.wantErrs == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(counts, tt.wantCount) {
+				t.Errorf("expected queries %v, got %v", tt.wantCount, counts)
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantWait {
+				t.Errorf("expected the retries to back off for %v, took %v", tt.wantWait, elapsed)
+			}
+		})
+	}
+}
+
+func TestResolver_Lookup_ipv6OnlyNameServer(t *testing.T) {
+	// example.org is delegated without glue to a name server that only has an IPv6 address.
+	ns := netip.MustParseAddr("2001:db8::53")
+	resolver := &Resolver{
+		RootHints: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		Transport: &MemoryTransport{Servers: map[netip.AddrPort]Handler{
+			netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), DefaultPort): reply(func(question Question) Message {
+				var response Message
+				if string(question.Name) != "ns.example.net" {
+					response.Authorities = []Record{testRecord("example.org", &NS{Host: "ns.example.net"})}
+					return response
+				}
+				response.Header.SetAA(true)
+				if question.Type == TypeAAAA {
+					response.Answers = []Record{testRecord("ns.example.net", &AAAA{Addr: ns})}
+				} else {
+					response.Authorities = []Record{testRecord("example.net", &SOA{MName: "ns.example.net", RName: "hostmaster.example.net"})}
+				}
+				return response
+			}),
+			netip.AddrPortFrom(ns, DefaultPort): reply(func(question Question) Message {
+				var response Message
+				response.Header.SetAA(true)
+				response.Answers = []Record{testRecord(string(question.Name), &A{Addr: netip.MustParseAddr("203.0.113.5")})}
+				return response
+			}),
+		}},
+	}
+	ips, err := resolver.ResolveContext(context.Background(), "www.example.org", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("203.0.113.5")}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("expected %v, got %v", want, ips)
+	}
+}
@@ -0,0 +1,187 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// rootServers lists the 13 root name servers with their IPv4 and IPv6 addresses, as published
+// by IANA in the root hints file at https://www.internic.net/domain/named.root.
+var rootServers = []struct {
+	name string
+	ipv4 string
+	ipv6 string
+}{
+	{"a.root-servers.net", "198.41.0.4", "2001:503:ba3e::2:30"},
+	{"b.root-servers.net", "170.247.170.2", "2801:1b8:10::b"},
+	{"c.root-servers.net", "192.33.4.12", "2001:500:2::c"},
+	{"d.root-servers.net", "199.7.91.13", "2001:500:2d::d"},
+	{"e.root-servers.net", "192.203.230.10", "2001:500:a8::e"},
+	{"f.root-servers.net", "192.5.5.241", "2001:500:2f::f"},
+	{"g.root-servers.net", "192.112.36.4", "2001:500:12::d0d"},
+	{"h.root-servers.net", "198.97.190.53", "2001:500:1::53"},
+	{"i.root-servers.net", "192.36.148.17", "2001:7fe::53"},
+	{"j.root-servers.net", "192.58.128.30", "2001:503:c27::2:30"},
+	{"k.root-servers.net", "193.0.14.129", "2001:7fd::1"},
+	{"l.root-servers.net", "199.7.83.42", "2001:500:9f::42"},
+	{"m.root-servers.net", "202.12.27.33", "2001:dc3::35"},
+}
+
+// DefaultRootHints returns the IPv4 and IPv6 addresses of the 13 root name servers.
+// It is used by a Resolver whose RootHints are empty.
+func DefaultRootHints() []netip.Addr {
+	hints := make([]netip.Addr, 0, 2*len(rootServers))
+	for _, server := range rootServers {
+		hints = append(hints, netip.MustParseAddr(server.ipv4), netip.MustParseAddr(server.ipv6))
+	}
+	return hints
+}
+
+// ParseRootHints reads a root hints file in the format of named.root, and returns the addresses
+// of the name servers named by the NS records of the root, in the order they appear.
+//
+// Only the subset of the zone file format of [RFC 1035 section 5] used by root hints files is
+// understood: one record per line, with an optional TTL and class, and comments starting with ';'.
+// Records of types other than NS, A and AAAA are ignored.
+//
+// [RFC 1035 section 5]: https://datatracker.ietf.org/doc/html/rfc1035#section-5
+func ParseRootHints(r io.Reader) ([]netip.Addr, error) {
+	rootNS := map[string]bool{}
+	type glue struct {
+		host string
+		addr netip.Addr
+	}
+	var glues []glue
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		owner := canonicalName(fields[0])
+		fields = fields[1:]
+		// Skip the optional TTL and class, which may appear in either order.
+		for len(fields) > 0 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil || strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+				continue
+			}
+			break
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: line %d: expected a type and data", ErrBadRootHints, line)
+		}
+
+		recordType, data := strings.ToUpper(fields[0]), fields[1]
+		switch recordType {
+		case "NS":
+			if owner != "" {
+				continue
+			}
+			rootNS[canonicalName(data)] = true
+		case "A", "AAAA":
+			addr, err := netip.ParseAddr(data)
+			if err != nil || addr.Is4() != (recordType == "A") {
+				return nil, fmt.Errorf("%w: line %d: bad %s address %q", ErrBadRootHints, line, recordType, data)
+			}
+			glues = append(glues, glue{host: owner, addr: addr})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var hints []netip.Addr
+	for _, g := range glues {
+		if rootNS[g.host] {
+			hints = append(hints, g.addr)
+		}
+	}
+	if len(hints) == 0 {
+		return nil, ErrNoRootServers
+	}
+	return hints, nil
+}
+
+// Prime queries the root hints for the current NS records of the root zone, and starts every later
+// resolution from the addresses included with them, as described in [RFC 8109]. This keeps the
+// resolver working when the root hints it was configured with have become outdated.
+// If priming fails, the resolver keeps using its root hints.
+//
+// [RFC 8109]: https://datatracker.ietf.org/doc/html/rfc8109
+func (r *Resolver) Prime(ctx context.Context) error {
+	ctx, cancel, convert := r.withDuration(ctx)
+	defer cancel()
+	response, err := r.queryServers(ctx, r.roots(), "", ".", "NS", r.newBudget(), 0)
+	if err != nil {
+		return convert(".", err)
+	}
+	var primed []netip.Addr
+	for _, answer := range response.Answers {
+		ns, ok := answer.Data.(*NS)
+		if !ok || canonicalName(string(answer.Name)) != "" {
+			continue
+		}
+		for _, glue := range FilterByName(response.Additionals, ns.Host) {
+			if addr := recordAddr(glue); addr.IsValid() {
+				primed = append(primed, addr)
+			}
+		}
+	}
+	if len(primed) == 0 {
+		return fmt.Errorf("%w in priming response", ErrNoRootServers)
+	}
+	r.logf("primed %d root server addresses", len(primed))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.primed = primed
+	return nil
+}
+
+// rootHints returns the addresses found by the last successful call to Prime, or else the
+// configured root hints, or else DefaultRootHints.
+func (r *Resolver) rootHints() []netip.Addr {
+	r.mu.Lock()
+	primed := r.primed
+	r.mu.Unlock()
+	if primed != nil {
+		return primed
+	}
+	if len(r.RootHints) == 0 {
+		return DefaultRootHints()
+	}
+	return r.RootHints
+}
+
+// roots returns the root servers to start a resolution from. Each call starts one server further
+// along the root hints, so that queries are spread across the root servers. IPv4 addresses come
+// before IPv6 addresses, as not every network can reach IPv6 servers.
+func (r *Resolver) roots() []nameserver {
+	var ipv4, ipv6 []nameserver
+	for _, addr := range r.rootHints() {
+		if addr.Is4() {
+			ipv4 = append(ipv4, nameserver{addr: addr})
+		} else {
+			ipv6 = append(ipv6, nameserver{addr: addr})
+		}
+	}
+	start := r.nextRoot.Add(1) - 1
+	return append(rotate(ipv4, start), rotate(ipv6, start)...)
+}
+
+// rotate returns the servers starting from the one at index n, wrapping around to the start of the list.
+func rotate(servers []nameserver, n uint32) []nameserver {
+	if len(servers) == 0 {
+		return servers
+	}
+	i := int(n % uint32(len(servers)))
+	return append(servers[i:len(servers):len(servers)], servers[:i]...)
+}
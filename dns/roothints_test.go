@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefaultRootHints(t *testing.T) {
+	hints := DefaultRootHints()
+	if len(hints) != 26 {
+		t.Fatalf("expected 26 addresses, got %d", len(hints))
+	}
+	if hints[0] != netip.MustParseAddr("198.41.0.4") {
+		t.Errorf("expected a.root-servers.net first, got %v", hints[0])
+	}
+	hints[0] = netip.Addr{}
+	if DefaultRootHints()[0] != netip.MustParseAddr("198.41.0.4") {
+		t.Error("expected every call to return a new list")
+	}
+}
+
+const namedRoot = `;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+;
+; FORMERLY NS.INTERNIC.NET
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+; FORMERLY NS1.ISI.EDU
+;
+.                        3600000  IN  NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      IN           AAAA  2801:1b8:10::b
+UNRELATED.EXAMPLE.       3600000      A     192.0.2.1
+; End of file
+`
+
+func TestParseRootHints(t *testing.T) {
+	tests := []struct {
+		name    string
+		hints   string
+		want    []string
+		wantErr error
+	}{
+		{
+			name:  "named.root",
+			hints: namedRoot,
+			want:  []string{"198.41.0.4", "2001:503:ba3e::2:30", "170.247.170.2", "2801:1b8:10::b"},
+		},
+		{
+			name:  "addresses before NS records",
+			hints: "a.root-servers.net 3600 A 198.41.0.4\n. 3600 NS a.root-servers.net\n",
+			want:  []string{"198.41.0.4"},
+		},
+		{
+			name:    "no NS records",
+			hints:   "A.ROOT-SERVERS.NET. 3600000 A 198.41.0.4\n",
+			wantErr: ErrNoRootServers,
+		},
+		{
+			name:    "missing data",
+			hints:   ". 3600000 NS\n",
+			wantErr: ErrBadRootHints,
+		},
+		{
+			name:    "bad address",
+			hints:   "A.ROOT-SERVERS.NET. 3600000 A 2001:503:ba3e::2:30\n",
+			wantErr: ErrBadRootHints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRootHints(strings.NewReader(tt.hints))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			var want []netip.Addr
+			for _, addr := range tt.want {
+				want = append(want, netip.MustParseAddr(addr))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestResolver_roots(t *testing.T) {
+	resolver := &Resolver{RootHints: []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	}}
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		roots := resolver.roots()
+		if len(roots) != 4 || roots[3].addr != netip.MustParseAddr("2001:db8::1") {
+			t.Fatalf("expected every root with IPv6 last, got %v", roots)
+		}
+		firsts = append(firsts, roots[0].addr.String())
+	}
+	want := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"}
+	if !reflect.DeepEqual(firsts, want) {
+		t.Errorf("expected successive resolutions to start at %v, got %v", want, firsts)
+	}
+}
+
+func TestResolver_Prime(t *testing.T) {
+	resolver := fakeHierarchy()
+	transport := resolver.Transport.(*MemoryTransport)
+	transport.Servers[netip.MustParseAddrPort("192.0.2.1:53")] = reply(func(question Question) Message {
+		var response Message
+		response.Header.SetAA(true)
+		if string(question.Name) != "" || question.Type != TypeNS {
+			response.SetRcode(RcodeRefused)
+			return response
+		}
+		response.Answers = []Record{testRecord("", &NS{Host: "new.root-servers.test"})}
+		response.Additionals = []Record{testRecord("new.root-servers.test", &A{Addr: netip.MustParseAddr("192.0.2.9")})}
+		return response
+	})
+
+	if err := resolver.Prime(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolver.roots(); len(got) != 1 || got[0].addr != netip.MustParseAddr("192.0.2.9") {
+		t.Errorf("expected the primed root server, got %v", got)
+	}
+}
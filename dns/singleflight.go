@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+)
+
+// flight is a resolution shared by every concurrent Lookup of the same question, so that a burst
+// of identical lookups sends a single set of queries.
+type flight struct {
+	// done is closed once records and err are set.
+	done    chan struct{}
+	records []Record
+	err     error
+	// waiters is the number of callers waiting for the result. It is guarded by the mu of the Resolver.
+	waiters int
+	// cancel stops the resolution once every waiter has given up on it.
+	cancel context.CancelFunc
+}
+
+// shareLookup looks up the records of the domain name like lookup, joining the resolution of
+// the same question if one is already in flight. The resolution is not tied to the context of
+// any single caller: a caller whose context is done stops waiting for it, and the resolution is
+// only cancelled once every caller has stopped waiting.
+func (r *Resolver) shareLookup(ctx context.Context, domainName string, recordType string) ([]Record, error) {
+	recType, ok := RecordTypes[recordType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, recordType)
+	}
+	key := cacheKey{name: canonicalName(domainName), rtype: recType.Value, class: ClassIn}
+
+	r.mu.Lock()
+	f, ok := r.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		if r.flights == nil {
+			r.flights = map[cacheKey]*flight{}
+		}
+		r.flights[key] = f
+		flightCtx, cancel := context.WithCancel(context.Background())
+		f.cancel = cancel
+		go r.fly(flightCtx, key, f, domainName, recordType)
+	}
+	f.waiters++
+	r.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return append([]Record(nil), f.records...), f.err
+	case <-ctx.Done():
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			// Later lookups of the question must not join a resolution that has been cancelled.
+			if r.flights[key] == f {
+				delete(r.flights, key)
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// fly runs the resolution of a flight and hands its result to the waiters.
+func (r *Resolver) fly(ctx context.Context, key cacheKey, f *flight, domainName string, recordType string) {
+	defer f.cancel()
+	ctx, cancel, convert := r.withDuration(ctx)
+	defer cancel()
+	records, err := r.lookup(ctx, domainName, recordType, r.newBudget(), 0)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.records, f.err = records, convert(domainName, err)
+	if r.flights[key] == f {
+		delete(r.flights, key)
+	}
+	close(f.done)
+}
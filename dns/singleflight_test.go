@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gateRoot makes the root server of the resolver's MemoryTransport hold every query until the
+// returned channel is closed.
+func gateRoot(resolver *Resolver) chan struct{} {
+	release := make(chan struct{})
+	transport := resolver.Transport.(*MemoryTransport)
+	root := netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), DefaultPort)
+	handler := transport.Servers[root]
+	transport.Servers[root] = func(ctx context.Context, query Message) (Message, error) {
+		select {
+		case <-release:
+			return handler(ctx, query)
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+	return release
+}
+
+// waitForWaiters waits until n lookups are waiting for the resolution of a question.
+func waitForWaiters(t *testing.T, resolver *Resolver, domainName string, recordType uint16, n int) {
+	t.Helper()
+	key := cacheKey{name: canonicalName(domainName), rtype: recordType, class: ClassIn}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resolver.mu.Lock()
+		f := resolver.flights[key]
+		waiters := 0
+		if f != nil {
+			waiters = f.waiters
+		}
+		resolver.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d lookups waiting for %s, got %d", n, domainName, waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResolver_Lookup_shared(t *testing.T) {
+	single := fakeHierarchy()
+	wantCounts := countQueries(single)
+	wantRecords, err := single.Lookup(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := fakeHierarchy()
+	release := gateRoot(resolver)
+	counts := countQueries(resolver)
+	const lookups = 100
+	var wg sync.WaitGroup
+	results := make([][]Record, lookups)
+	errs := make([]error, lookups)
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = resolver.Lookup(context.Background(), "www.example.com", "A")
+		}(i)
+	}
+	waitForWaiters(t, resolver, "www.example.com", TypeA, lookups)
+	close(release)
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil || !reflect.DeepEqual(results[i], wantRecords) {
+			t.Fatalf("expected every lookup to return %v, got %v, %v", wantRecords, results[i], errs[i])
+		}
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("expected the queries of a single resolution %v, got %v", wantCounts, counts)
+	}
+	if len(resolver.flights) != 0 {
+		t.Errorf("expected no resolutions left in flight, got %v", resolver.flights)
+	}
+}
+
+func TestResolver_Lookup_sharedCancel(t *testing.T) {
+	resolver := fakeHierarchy()
+	release := gateRoot(resolver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := resolver.Lookup(ctx, "www.example.com", "A")
+		cancelled <- err
+	}()
+	done := make(chan error)
+	go func() {
+		_, err := resolver.Lookup(context.Background(), "www.example.com", "A")
+		done <- err
+	}()
+	waitForWaiters(t, resolver, "www.example.com", TypeA, 2)
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("expected the remaining lookup to succeed, got %v", err)
+	}
+}
+
+func TestResolver_Lookup_sharedAbandoned(t *testing.T) {
+	resolver := fakeHierarchy()
+	release := gateRoot(resolver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := resolver.Lookup(ctx, "www.example.com", "A")
+		cancelled <- err
+	}()
+	waitForWaiters(t, resolver, "www.example.com", TypeA, 1)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+
+	// The abandoned resolution has been cancelled, so a new lookup starts a resolution of its own.
+	close(release)
+	if _, err := resolver.Lookup(context.Background(), "www.example.com", "A"); err != nil {
+		t.Errorf("expected a new lookup to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Decision is what a resolver made of the response to one of its queries.
+type Decision int
+
+const (
+	// DecisionAnswer means the response answered the question, possibly through aliases.
+	DecisionAnswer Decision = iota
+	// DecisionAlias means the response made the name an alias for a name it did not answer for,
+	// so the resolution carries on with the target of the alias.
+	DecisionAlias
+	// DecisionReferral means the response referred the resolver to other name servers,
+	// and included the addresses of some of them as glue.
+	DecisionReferral
+	// DecisionGluelessReferral means the response referred the resolver to other name servers
+	// without any of their addresses, which must be resolved before they can be queried.
+	DecisionGluelessReferral
+	// DecisionNegative means the response reported that the name does not exist,
+	// or that it has no records of the queried type, which ends the resolution.
+	DecisionNegative
+	// DecisionServerFailure means the server did not respond, or only reported a problem of its own,
+	// such as SERVFAIL or REFUSED, so the next server is tried.
+	DecisionServerFailure
+)
+
+var decisionNames = map[Decision]string{
+	DecisionAnswer:           "answer",
+	DecisionAlias:            "alias",
+	DecisionReferral:         "referral",
+	DecisionGluelessReferral: "glueless referral",
+	DecisionNegative:         "negative answer",
+	DecisionServerFailure:    "server failure",
+}
+
+func (d Decision) String() string {
+	if name, ok := decisionNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("Decision%d", int(d))
+}
+
+// MarshalText encodes the decision as its name, so that traces encoded as JSON are readable.
+func (d Decision) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Trace is the record of every query sent by a resolution, in the order they were sent. It holds
+// everything needed to show how the resolution went, whether as ascii art, JSON or log lines.
+// Answers found in the Cache of the resolver are returned without sending any query,
+// so they do not add any step.
+type Trace struct {
+	Steps []Step
+}
+
+// Step is a single query of a resolution, along with what the resolver made of its response.
+type Step struct {
+	// Depth is how deeply the query was nested: zero for the name being resolved, and one more for
+	// each name server without glue whose address had to be resolved first.
+	Depth int
+	// Server is the address of the name server that was queried.
+	Server netip.Addr
+	// Zone is the zone the server was queried as a name server of, in canonical form, or the empty
+	// string for the root. Records of the response outside the zone are not trusted.
+	Zone string
+	// Name and Type are the question sent to the server.
+	Name string
+	Type string
+	// Response is the response of the server, or the zero Message if it did not respond.
+	Response Message
+	// Raw is the response in wire format, exactly as received from the server. It is nil if the
+	// server did not respond, or if the Transport of the resolver is not a RawTransport.
+	Raw []byte
+	// Latency is how long the server took to respond, or how long the resolver waited for it.
+	Latency time.Duration
+	// Decision is what the resolver made of the response.
+	Decision Decision
+	// Err is the error that the query failed with, for DecisionNegative and DecisionServerFailure.
+	Err error
+}
+
+// MarshalJSON encodes the step with Err as its message, which is omitted if there is no error.
+func (s Step) MarshalJSON() ([]byte, error) {
+	type step Step
+	var message string
+	if s.Err != nil {
+		message = s.Err.Error()
+	}
+	return json.Marshal(struct {
+		step
+		Err string `json:",omitempty"`
+	}{step: step(s), Err: message})
+}
+
+// add appends a step to the trace. A nil trace records nothing.
+func (t *Trace) add(step Step) {
+	if t != nil {
+		t.Steps = append(t.Steps, step)
+	}
+}
+
+// traceStep returns the step for a query to a name server of the zone, given the response, its bytes
+// and the error returned by checkResponse, or the error of the query itself if the server did not respond.
+// It decides between answers and aliases with followZoneAliases, as lookup does.
+func traceStep(depth int, server netip.Addr, zone string, domainName string, recordType string, response Message, raw []byte, latency time.Duration, err error) Step {
+	step := Step{
+		Depth:    depth,
+		Server:   server,
+		Zone:     zone,
+		Name:     domainName,
+		Type:     recordType,
+		Response: response,
+		Raw:      raw,
+		Latency:  latency,
+		Err:      err,
+	}
+	switch chain, answers := followZoneAliases(response, zone); {
+	case err != nil && (isServerFailure(err) || !response.Header.QR()):
+		step.Decision = DecisionServerFailure
+	case err != nil:
+		step.Decision = DecisionNegative
+	case len(answers) > 0:
+		step.Decision = DecisionAnswer
+	case len(chain) > 0:
+		step.Decision = DecisionAlias
+	case hasGlue(response):
+		step.Decision = DecisionReferral
+	default:
+		step.Decision = DecisionGluelessReferral
+	}
+	return step
+}
+
+// hasGlue reports whether a referral includes the address of any of the name servers it refers to.
+func hasGlue(referral Message) bool {
+	for _, server := range referralServers(referral) {
+		if server.addr.IsValid() {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the step on a single line, such as
+// "www.example.com A @192.0.2.1: referral to ns.nic.com in 12ms".
+func (s Step) String() string {
+	var outcome string
+	switch s.Decision {
+	case DecisionAnswer:
+		_, answers := followZoneAliases(s.Response, s.Zone)
+		data := make([]string, len(answers))
+		for i, answer := range answers {
+			data[i] = fmt.Sprint(answer.Data)
+		}
+		outcome = "answer " + strings.Join(data, ", ")
+	case DecisionAlias:
+		chain, _ := followZoneAliases(s.Response, s.Zone)
+		outcome = "alias for " + aliasTarget(chain)
+	case DecisionReferral, DecisionGluelessReferral:
+		var hosts []string
+		for _, record := range s.Response.Authorities {
+			if ns, ok := record.Data.(*NS); ok {
+				hosts = append(hosts, ns.Host)
+			}
+		}
+		outcome = fmt.Sprintf("%s to %s", s.Decision, strings.Join(hosts, ", "))
+	default:
+		outcome = fmt.Sprintf("%s: %v", s.Decision, s.Err)
+	}
+	return fmt.Sprintf("%s %s @%s: %s in %v", s.Name, s.Type, s.Server, outcome, s.Latency.Round(time.Millisecond))
+}
+
+// String describes every step of the trace on a line of its own,
+// indented by two spaces for each level of nesting.
+func (t Trace) String() string {
+	var b strings.Builder
+	for _, step := range t.Steps {
+		b.WriteString(strings.Repeat("  ", step.Depth))
+		b.WriteString(step.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolver_ResolveTrace(t *testing.T) {
+	type step struct {
+		depth    int
+		server   string
+		name     string
+		decision Decision
+	}
+	// Every name in example.com is first referred to its name server, whose address has to be resolved.
+	delegation := func(name string) []step {
+		return []step{
+			{0, "192.0.2.1", name, DecisionReferral},
+			{0, "192.0.2.2", name, DecisionGluelessReferral},
+			{1, "192.0.2.1", "ns.example.net", DecisionReferral},
+			{1, "192.0.2.2", "ns.example.net", DecisionReferral},
+			{1, "192.0.2.3", "ns.example.net", DecisionAnswer},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		domainName string
+		wantSteps  []step
+		wantIPs    []netip.Addr
+		wantErr    error
+	}{
+		{
+			name:       "answer",
+			domainName: "www.example.com",
+			wantSteps:  append(delegation("www.example.com"), step{0, "192.0.2.3", "www.example.com", DecisionAnswer}),
+			wantIPs:    []netip.Addr{netip.MustParseAddr("203.0.113.1"), netip.MustParseAddr("203.0.113.2")},
+		},
+		{
+			name:       "alias",
+			domainName: "other.example.com",
+			wantSteps: append(delegation("other.example.com"),
+				step{0, "192.0.2.3", "other.example.com", DecisionAlias},
+				step{0, "192.0.2.1", "host.example.net", DecisionReferral},
+				step{0, "192.0.2.2", "host.example.net", DecisionReferral},
+				step{0, "192.0.2.3", "host.example.net", DecisionNegative},
+			),
+			wantErr: ErrNoData,
+		},
+		{
+			name:       "NXDOMAIN",
+			domainName: "missing.example.com",
+			wantSteps:  append(delegation("missing.example.com"), step{0, "192.0.2.3", "missing.example.com", DecisionNegative}),
+			wantErr:    ErrNXDomain,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, trace, err := fakeHierarchy().ResolveTrace(context.Background(), tt.domainName, "A")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(ips, tt.wantIPs) {
+				t.Errorf("expected %v, got %v", tt.wantIPs, ips)
+			}
+			var steps []step
+			for _, s := range trace.Steps {
+				steps = append(steps, step{s.Depth, s.Server.String(), s.Name, s.Decision})
+				if s.Type != "A" || s.Raw == nil {
+					t.Errorf("expected an A query with a raw response, got %+v", s)
+				}
+			}
+			if !reflect.DeepEqual(steps, tt.wantSteps) {
+				t.Errorf("expected steps\n%v\ngot\n%v", tt.wantSteps, steps)
+			}
+			if last := trace.Steps[len(trace.Steps)-1]; !errors.Is(last.Err, tt.wantErr) {
+				t.Errorf("expected the last step to fail with %v, got %v", tt.wantErr, last.Err)
+			}
+		})
+	}
+}
+
+func TestResolver_ResolveTrace_serverFailure(t *testing.T) {
+	resolver := fakeHierarchy()
+	resolver.infra.intn = func(n int) int { return n - 1 }
+	resolver.RootHints = []netip.Addr{netip.MustParseAddr("192.0.2.9"), netip.MustParseAddr("192.0.2.1")}
+	_, trace, err := resolver.ResolveTrace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := trace.Steps[0]
+	if first.Decision != DecisionServerFailure || !errors.Is(first.Err, ErrUnreachable) || first.Raw != nil {
+		t.Errorf("expected the unreachable root server to fail, got %+v", first)
+	}
+	if second := trace.Steps[1]; second.Server != netip.MustParseAddr("192.0.2.1") || second.Decision != DecisionReferral {
+		t.Errorf("expected the next root server to refer the query, got %+v", second)
+	}
+}
+
+func TestResolver_ResolveTrace_outOfZone(t *testing.T) {
+	resolver := fakeHierarchy()
+	transport := resolver.Transport.(*MemoryTransport)
+	authoritative := netip.AddrPortFrom(netip.MustParseAddr("192.0.2.3"), DefaultPort)
+	handler := transport.Servers[authoritative]
+	// The name server of example.com answers for the target of an alias outside its zone.
+	transport.Servers[authoritative] = func(ctx context.Context, query Message) (Message, error) {
+		response, err := handler(ctx, query)
+		if string(query.Questions[0].Name) == "other.example.com" {
+			response.Answers = append(response.Answers, testRecord("host.example.net", &AAAA{Addr: netip.MustParseAddr("2001:db8::666")}))
+		}
+		return response, err
+	}
+
+	ips, trace, err := resolver.ResolveTrace(context.Background(), "other.example.com", "AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("2001:db8::1")}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("expected %v, got %v", want, ips)
+	}
+	for _, step := range trace.Steps {
+		if step.Name == "other.example.com" && step.Server == authoritative.Addr() && step.Decision != DecisionAlias {
+			t.Errorf("expected the out of zone answer to be traced as an alias, got %v", step)
+		}
+	}
+	if strings.Contains(trace.String(), "2001:db8::666") {
+		t.Errorf("expected the out of zone answer to be left out of the trace, got\n%s", trace)
+	}
+}
+
+func TestTrace_String(t *testing.T) {
+	referral := Message{
+		Header:      Header{Flags: flagQR},
+		Authorities: []Record{testRecord("example.com", &NS{Host: "ns.example.net"})},
+	}
+	answer := Message{
+		Header:    Header{Flags: flagQR | flagAA},
+		Questions: []Question{{Name: []byte("ns.example.net"), Type: TypeA, Class: ClassIn}},
+		Answers:   []Record{testRecord("ns.example.net", &A{Addr: netip.MustParseAddr("192.0.2.3")})},
+	}
+	trace := Trace{Steps: []Step{
+		{Server: netip.MustParseAddr("192.0.2.2"), Name: "www.example.com", Type: "A", Response: referral, Latency: 12 * time.Millisecond, Decision: DecisionGluelessReferral},
+		{Depth: 1, Server: netip.MustParseAddr("192.0.2.9"), Name: "ns.example.net", Type: "A", Latency: time.Second, Decision: DecisionServerFailure, Err: ErrUnreachable},
+		{Depth: 1, Server: netip.MustParseAddr("192.0.2.3"), Name: "ns.example.net", Type: "A", Response: answer, Latency: 3 * time.Millisecond, Decision: DecisionAnswer},
+	}}
+	want := strings.Join([]string{
+		"www.example.com A @192.0.2.2: glueless referral to ns.example.net in 12ms",
+		"  ns.example.net A @192.0.2.9: server failure: dns: name server unreachable in 1s",
+		"  ns.example.net A @192.0.2.3: answer 192.0.2.3 in 3ms",
+		"",
+	}, "\n")
+	if got := trace.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	encoded, err := json.Marshal(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Steps []struct {
+			Decision string
+			Err      string
+			Response struct {
+				Questions   []struct{ Name string }
+				Answers     []struct{ Name string }
+				Authorities []struct {
+					Name string
+					Data struct{ Host string }
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("expected names and errors to be encoded as strings, got %v decoding %s", err, encoded)
+	}
+	steps := decoded.Steps
+	if len(steps) != 3 || steps[0].Decision != "glueless referral" || steps[0].Err != "" {
+		t.Fatalf("expected decisions to be encoded by name, got %s", encoded)
+	}
+	if authority := steps[0].Response.Authorities[0]; authority.Name != "example.com" || authority.Data.Host != "ns.example.net" {
+		t.Errorf("expected the referral to example.com, got %+v", authority)
+	}
+	if steps[1].Err != ErrUnreachable.Error() {
+		t.Errorf("expected error %q, got %q", ErrUnreachable, steps[1].Err)
+	}
+	response := steps[2].Response
+	if response.Questions[0].Name != "ns.example.net" || response.Answers[0].Name != "ns.example.net" {
+		t.Errorf("expected the question and answer for ns.example.net, got %+v", response)
+	}
+}
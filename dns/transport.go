@@ -0,0 +1,297 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// maxMessageSize is the largest DNS message that can be sent over TCP, as its length is
+// given as a two byte integer.
+const maxMessageSize = 65535
+
+// Transport exchanges a query with a name server and returns its response.
+// Implementations must only return responses that match the query, as reported by matchesQuery,
+// and must give up as soon as the context is cancelled or its deadline passes.
+type Transport interface {
+	Exchange(ctx context.Context, server netip.AddrPort, query Message) (Message, error)
+}
+
+// RawTransport is a Transport that can also return each response in wire format, exactly as it
+// was received from the server, which the resolver keeps in the steps of a Trace.
+// UDPTransport, TCPTransport and MemoryTransport implement it.
+type RawTransport interface {
+	Transport
+	// ExchangeRaw works like Exchange, and also returns the bytes of the response it parsed.
+	ExchangeRaw(ctx context.Context, server netip.AddrPort, query Message) (Message, []byte, error)
+}
+
+// UDPTransport sends queries over UDP, and repeats them over TCP when the response is truncated,
+// as described in [RFC 7766 section 5].
+//
+// [RFC 7766 section 5]: https://datatracker.ietf.org/doc/html/rfc7766#section-5
+type UDPTransport struct {
+	// Timeout is the longest time to wait for each message exchanged with the server.
+	// If zero, DefaultTimeout is used.
+	Timeout time.Duration
+}
+
+// Exchange sends the query to the server over UDP, falling back to TCP if the response was truncated.
+func (t *UDPTransport) Exchange(ctx context.Context, server netip.AddrPort, query Message) (Message, error) {
+	response, _, err := t.ExchangeRaw(ctx, server, query)
+	return response, err
+}
+
+// ExchangeRaw works like Exchange, and also returns the bytes of the response, which are
+// those received over TCP if the response over UDP was truncated.
+func (t *UDPTransport) ExchangeRaw(ctx context.Context, server netip.AddrPort, query Message) (Message, []byte, error) {
+	timeout := transportTimeout(t.Timeout)
+	response, raw, err := exchangeUDP(ctx, server.String(), query, timeout)
+	if err != nil || !response.Header.TC() {
+		return response, raw, err
+	}
+	return exchangeTCP(ctx, server.String(), query, timeout)
+}
+
+// TCPTransport sends every query over its own TCP connection.
+type TCPTransport struct {
+	// Timeout is the longest time to wait for the message exchange with the server.
+	// If zero, DefaultTimeout is used.
+	Timeout time.Duration
+}
+
+// Exchange sends the query to the server over TCP.
+func (t *TCPTransport) Exchange(ctx context.Context, server netip.AddrPort, query Message) (Message, error) {
+	response, _, err := t.ExchangeRaw(ctx, server, query)
+	return response, err
+}
+
+// ExchangeRaw works like Exchange, and also returns the bytes of the response.
+func (t *TCPTransport) ExchangeRaw(ctx context.Context, server netip.AddrPort, query Message) (Message, []byte, error) {
+	return exchangeTCP(ctx, server.String(), query, transportTimeout(t.Timeout))
+}
+
+// transportTimeout returns the timeout of a transport, or DefaultTimeout if it is not set.
+func transportTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultTimeout
+	}
+	return timeout
+}
+
+// Handler answers a query sent to a server of a MemoryTransport.
+type Handler func(ctx context.Context, query Message) (Message, error)
+
+// MemoryTransport delivers queries to handlers in the same process, without using the network,
+// which makes it possible to run resolutions against a fake set of name servers.
+//
+// Queries and responses are packed and parsed on their way, so that handlers and callers see the
+// same messages they would receive over the network, and responses that do not match their query
+// are rejected with ErrMismatchedResponse.
+type MemoryTransport struct {
+	// Servers maps the address of each name server to the handler that answers its queries.
+	// Queries to any other address fail with ErrUnreachable.
+	Servers map[netip.AddrPort]Handler
+}
+
+// Exchange passes the query to the handler of the server and returns its response.
+func (t *MemoryTransport) Exchange(ctx context.Context, server netip.AddrPort, query Message) (Message, error) {
+	response, _, err := t.ExchangeRaw(ctx, server, query)
+	return response, err
+}
+
+// ExchangeRaw works like Exchange, and also returns the response of the handler as packed
+// on its way to the caller.
+func (t *MemoryTransport) ExchangeRaw(ctx context.Context, server netip.AddrPort, query Message) (Message, []byte, error) {
+	if ctx.Err() != nil {
+		return Message{}, nil, queryError(ctx, server.String(), ctx.Err())
+	}
+	handler, ok := t.Servers[server]
+	if !ok {
+		return Message{}, nil, queryError(ctx, server.String(), ErrUnreachable)
+	}
+	request, err := query.Pack()
+	if err != nil {
+		return Message{}, nil, err
+	}
+	if query, err = ParseMessage(request); err != nil {
+		return Message{}, nil, err
+	}
+	response, err := handler(ctx, query)
+	if err != nil {
+		return Message{}, nil, queryError(ctx, server.String(), err)
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		return Message{}, nil, err
+	}
+	if response, err = ParseMessage(packed); err != nil {
+		return Message{}, nil, err
+	}
+	if !matchesQuery(query, response) {
+		return Message{}, nil, fmt.Errorf("%w from %s", ErrMismatchedResponse, server)
+	}
+	return response, packed, nil
+}
+
+// exchangeUDP sends a query in a single UDP datagram from a random source port, and parses the
+// response datagram, which it returns along with the message. Datagrams that cannot be parsed or
+// do not match the query are discarded, and reading continues until a matching response arrives
+// or the query times out.
+func exchangeUDP(ctx context.Context, address string, query Message, timeout time.Duration) (Message, []byte, error) {
+	request, err := query.Pack()
+	if err != nil {
+		return Message{}, nil, err
+	}
+	con, stop, err := dial(ctx, "udp", address, timeout)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	defer stop()
+
+	if _, err = con.Write(request); err != nil {
+		return Message{}, nil, queryError(ctx, address, err)
+	}
+	response := make([]byte, query.MaxUDPSize())
+	for {
+		n, err := con.Read(response)
+		if err != nil {
+			return Message{}, nil, queryError(ctx, address, err)
+		}
+		message, err := ParseMessage(response[:n])
+		if err == nil && matchesQuery(query, message) {
+			return message, response[:n], nil
+		}
+	}
+}
+
+// exchangeTCP sends a query over a TCP connection and parses the response, which it returns along
+// with the message without its length prefix. Over TCP,
+// each message is prefixed with its length as a two byte integer,
+// as defined in [RFC 1035 section 4.2.2].
+//
+// [RFC 1035 section 4.2.2]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+func exchangeTCP(ctx context.Context, address string, query Message, timeout time.Duration) (Message, []byte, error) {
+	request, err := query.Pack()
+	if err != nil {
+		return Message{}, nil, err
+	}
+	if len(request) > maxMessageSize {
+		return Message{}, nil, ErrMessageTooLarge
+	}
+	con, stop, err := dial(ctx, "tcp", address, timeout)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	defer stop()
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(request)))
+	if _, err = con.Write(append(framed, request...)); err != nil {
+		return Message{}, nil, queryError(ctx, address, err)
+	}
+	var length uint16
+	if err = binary.Read(con, binary.BigEndian, &length); err != nil {
+		return Message{}, nil, queryError(ctx, address, err)
+	}
+	response := make([]byte, length)
+	if _, err = io.ReadFull(con, response); err != nil {
+		return Message{}, nil, queryError(ctx, address, err)
+	}
+	message, err := ParseMessage(response)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	if !matchesQuery(query, message) {
+		return Message{}, nil, fmt.Errorf("%w from %s", ErrMismatchedResponse, address)
+	}
+	return message, response, nil
+}
+
+// matchesQuery reports whether a message is a response to the query, as described in
+// [RFC 5452 section 9.1]: it must have the same ID and question as the query, and have the QR bit set.
+// Responses reporting an error are also accepted without a question section,
+// since some name servers leave it out of FORMERR and NOTIMP responses.
+//
+// [RFC 5452 section 9.1]: https://datatracker.ietf.org/doc/html/rfc5452#section-9.1
+func matchesQuery(query Message, response Message) bool {
+	if response.Header.ID != query.Header.ID || !response.Header.QR() {
+		return false
+	}
+	if len(response.Questions) == 0 {
+		return response.Rcode() != RcodeSuccess
+	}
+	if len(response.Questions) != len(query.Questions) {
+		return false
+	}
+	for i, question := range response.Questions {
+		expected := query.Questions[i]
+		if question.Type != expected.Type || question.Class != expected.Class ||
+			!equalNames(string(question.Name), string(expected.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// dial connects to the address, and limits the connection to the timeout or the deadline of
+// the context, whichever comes first. Cancelling the context interrupts any pending reads or writes.
+// The returned stop function closes the connection and must always be called.
+func dial(ctx context.Context, network string, address string, timeout time.Duration) (net.Conn, func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	var dialer net.Dialer
+	var con net.Conn
+	var err error
+	if network == "udp" {
+		// A random source port makes responses harder to spoof, as an attacker has to guess
+		// the port as well as the query ID. If a few ports in a row are already in use,
+		// fall back to letting the operating system choose one.
+		for attempt := 0; attempt < 3 && con == nil; attempt++ {
+			dialer.LocalAddr = &net.UDPAddr{Port: randomPort()}
+			con, err = dialer.DialContext(ctx, network, address)
+		}
+		dialer.LocalAddr = nil
+	}
+	if con == nil {
+		con, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		// The error must be built before cancelling, which would make it look like the caller cancelled.
+		err = queryError(ctx, address, err)
+		cancel()
+		return nil, nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	_ = con.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Setting a deadline in the past unblocks any pending reads or writes.
+			_ = con.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	stop := func() {
+		close(done)
+		cancel()
+		_ = con.Close()
+	}
+	return con, stop, nil
+}
+
+// queryError wraps an error from exchanging messages with the server at address.
+// Errors caused by the context being cancelled or its deadline passing are reported as the context error.
+func queryError(ctx context.Context, address string, err error) error {
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		// The connection deadline can fire just before the context notices its own deadline.
+		err = context.DeadlineExceeded
+	}
+	return fmt.Errorf("dns: query to %s: %w", address, err)
+}
@@ -0,0 +1,330 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// largeResponse returns a response to the query with enough TXT records to exceed the
+// size of a UDP datagram without EDNS.
+func largeResponse(query Message) Message {
+	response := query
+	response.Header.SetQR(true)
+	response.EDNS = nil
+	for i := 0; i < 20; i++ {
+		response.Answers = append(response.Answers, Record{
+			Name:  query.Questions[0].Name,
+			Type:  TypeTXT,
+			Class: ClassIn,
+			TTL:   60,
+			Data:  &TXT{Text: []string{strings.Repeat("x", 200)}},
+		})
+	}
+	return response
+}
+
+// serveLargeResponse accepts a single TCP connection on the listener, and answers the query
+// read from it with largeResponse.
+func serveLargeResponse(listener net.Listener) {
+	con, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer con.Close()
+	var length uint16
+	_ = binary.Read(con, binary.BigEndian, &length)
+	request := make([]byte, length)
+	_, _ = io.ReadFull(con, request)
+	query, _ := ParseMessage(request)
+	response, _ := largeResponse(query).Pack()
+	_ = binary.Write(con, binary.BigEndian, uint16(len(response)))
+	_, _ = con.Write(response)
+}
+
+func TestTCPTransport_Exchange(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serveLargeResponse(listener)
+
+	query := NewQuery(1, "example.com", TypeTXT)
+	server := netip.MustParseAddrPort(listener.Addr().String())
+	response, err := (&TCPTransport{}).Exchange(context.Background(), server, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answers) != 20 {
+		t.Errorf("expected 20 answers, got %d", len(response.Answers))
+	}
+}
+
+func TestTCPTransport_Exchange_refused(t *testing.T) {
+	// Listen only to pick a port, then close it so that connections to it are refused.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := netip.MustParseAddrPort(listener.Addr().String())
+	listener.Close()
+
+	_, err = (&TCPTransport{}).Exchange(context.Background(), server, NewQuery(1, "example.com", TypeA))
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the dial error, got %v", err)
+	}
+}
+
+func TestUDPTransport_Exchange_truncated(t *testing.T) {
+	// The UDP socket must share its port with the TCP listener, which may take a few attempts
+	// if the port picked for TCP is already in use for UDP.
+	var listener net.Listener
+	var con net.PacketConn
+	for attempt := 0; con == nil; attempt++ {
+		var err error
+		if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if con, err = net.ListenPacket("udp", listener.Addr().String()); err != nil {
+			listener.Close()
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	defer listener.Close()
+	defer con.Close()
+	go serveLargeResponse(listener)
+	go func() {
+		request := make([]byte, maxMessageSize)
+		n, from, err := con.ReadFrom(request)
+		if err != nil {
+			return
+		}
+		query, _ := ParseMessage(request[:n])
+		response := query
+		response.Header.SetQR(true)
+		response.Header.SetTC(true)
+		response.EDNS = nil
+		packed, _ := response.Pack()
+		_, _ = con.WriteTo(packed, from)
+	}()
+
+	server := netip.MustParseAddrPort(listener.Addr().String())
+	response, err := (&UDPTransport{}).Exchange(context.Background(), server, NewQuery(1, "example.com", TypeTXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.TC() || len(response.Answers) != 20 {
+		t.Errorf("expected the full response over TCP with 20 answers, got %v", response)
+	}
+}
+
+func TestUDPTransport_ExchangeRaw(t *testing.T) {
+	con, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	// The response is built without compressing the name of the answer, unlike Pack,
+	// so that the bytes received differ from the response packed again.
+	var sent []byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request := make([]byte, maxMessageSize)
+		n, from, err := con.ReadFrom(request)
+		if err != nil {
+			return
+		}
+		query, _ := ParseMessage(request[:n])
+		header := Header{ID: query.Header.ID, Flags: flagQR, NumQuestions: 1, NumAnswers: 1}
+		answer := testRecord("example.com", &A{Addr: netip.MustParseAddr("192.0.2.1")})
+		packed, _ := answer.ToBytes()
+		sent = append(append(header.ToBytes(), query.Questions[0].ToBytes()...), packed...)
+		_, _ = con.WriteTo(sent, from)
+	}()
+
+	server := netip.MustParseAddrPort(con.LocalAddr().String())
+	response, raw, err := (&UDPTransport{}).ExchangeRaw(context.Background(), server, NewQuery(1, "example.com", TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !bytes.Equal(raw, sent) {
+		t.Errorf("expected the bytes sent by the server\n%x\ngot\n%x", sent, raw)
+	}
+	if repacked, _ := response.Pack(); bytes.Equal(raw, repacked) {
+		t.Errorf("expected the response to be packed differently than it was received")
+	}
+}
+
+func TestUDPTransport_Exchange_unresponsive(t *testing.T) {
+	// A socket that never answers, to stand in for an unreachable name server.
+	con, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	server := netip.MustParseAddrPort(con.LocalAddr().String())
+	query := NewQuery(1, "example.com", TypeA)
+
+	t.Run("context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := (&UDPTransport{}).Exchange(ctx, server, query)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err := (&UDPTransport{}).Exchange(ctx, server, query)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected error %v, got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("query timeout", func(t *testing.T) {
+		transport := &UDPTransport{Timeout: 50 * time.Millisecond}
+		start := time.Now()
+		_, err := transport.Exchange(context.Background(), server, query)
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("expected a timeout error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected the query to time out after %v, took %v", transport.Timeout, elapsed)
+		}
+	})
+}
+
+func TestUDPTransport_Exchange_discardsMismatchedResponses(t *testing.T) {
+	con, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	go func() {
+		request := make([]byte, maxMessageSize)
+		n, from, err := con.ReadFrom(request)
+		if err != nil {
+			return
+		}
+		query, _ := ParseMessage(request[:n])
+		response := query
+		response.Header.SetQR(true)
+		response.Answers = []Record{
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIn, Data: &A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		}
+		spoofed := response
+		spoofed.Header.ID++
+		spoofed.Answers = []Record{
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIn, Data: &A{Addr: netip.MustParseAddr("203.0.113.66")}},
+		}
+		for _, m := range []Message{spoofed, response} {
+			packed, _ := m.Pack()
+			_, _ = con.WriteTo(packed, from)
+		}
+	}()
+
+	server := netip.MustParseAddrPort(con.LocalAddr().String())
+	response, err := (&UDPTransport{}).Exchange(context.Background(), server, NewQuery(0x1234, "example.com", TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetAnswer(response); got != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("expected the spoofed response to be discarded, got answer %v", got)
+	}
+}
+
+func Test_matchesQuery(t *testing.T) {
+	query := NewQuery(0x1234, "www.example.com", TypeA)
+	response := func(modify func(*Message)) Message {
+		m := NewQuery(0x1234, "www.example.com", TypeA)
+		m.Header.SetQR(true)
+		modify(&m)
+		return m
+	}
+	tests := []struct {
+		name     string
+		response Message
+		want     bool
+	}{
+		{name: "matching", response: response(func(m *Message) {}), want: true},
+		{name: "name in a different case", response: response(func(m *Message) { m.Questions[0].Name = []byte("WWW.Example.COM.") }), want: true},
+		{name: "different ID", response: response(func(m *Message) { m.Header.ID = 0x4321 }), want: false},
+		{name: "not a response", response: response(func(m *Message) { m.Header.SetQR(false) }), want: false},
+		{name: "different name", response: response(func(m *Message) { m.Questions[0].Name = []byte("evil.example.com") }), want: false},
+		{name: "different type", response: response(func(m *Message) { m.Questions[0].Type = TypeAAAA }), want: false},
+		{name: "different class", response: response(func(m *Message) { m.Questions[0].Class = 3 }), want: false},
+		{name: "no question", response: response(func(m *Message) { m.Questions = nil }), want: false},
+		{
+			name: "FORMERR without question",
+			response: response(func(m *Message) {
+				m.Questions = nil
+				m.Header.SetRcode(RcodeFormatError)
+			}),
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesQuery(query, tt.response); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMemoryTransport_Exchange(t *testing.T) {
+	server := netip.MustParseAddrPort("192.0.2.1:53")
+	answer := testRecord("example.com", &A{Addr: netip.MustParseAddr("203.0.113.1")})
+	transport := &MemoryTransport{Servers: map[netip.AddrPort]Handler{
+		server: func(ctx context.Context, query Message) (Message, error) {
+			response := query
+			response.Header.SetQR(true)
+			response.Answers = []Record{answer}
+			if string(query.Questions[0].Name) == "mismatched.example.com" {
+				response.Header.ID++
+			}
+			return response, nil
+		},
+	}}
+
+	response, err := transport.Exchange(context.Background(), server, NewQuery(1, "example.com", TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := GetAnswer(response); got != netip.MustParseAddr("203.0.113.1") {
+		t.Errorf("expected answer 203.0.113.1, got %v", got)
+	}
+
+	_, err = transport.Exchange(context.Background(), server, NewQuery(1, "mismatched.example.com", TypeA))
+	if !errors.Is(err, ErrMismatchedResponse) {
+		t.Errorf("expected error %v, got %v", ErrMismatchedResponse, err)
+	}
+
+	unknown := netip.MustParseAddrPort("192.0.2.2:53")
+	_, err = transport.Exchange(context.Background(), unknown, NewQuery(1, "example.com", TypeA))
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("expected error %v, got %v", ErrUnreachable, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = transport.Exchange(ctx, server, NewQuery(1, "example.com", TypeA))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
 	"github.com/lucasmelin/dinosaur/dino"
 	"github.com/lucasmelin/dinosaur/dns"
@@ -22,10 +23,21 @@ func main() {
 		d.SayLeft(fmt.Sprintf("I wonder how I can reach %s", url))
 		fmt.Println("\nPress any key to continue the journey...")
 		_, _ = fmt.Scanln()
-		ipAddress := string(dns.AsciiResolve(url, "A", *impatient))
-		d.SayLeft(fmt.Sprintf("Great, now I know I can reach %s at %s", url, ipAddress))
+		ipAddresses, err := dns.AsciiResolve(url, "A", *impatient)
+		if err != nil {
+			d.SayLeft(fmt.Sprintf("Oh no, I can't reach %s", url))
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		d.SayLeft(fmt.Sprintf("Great, now I know I can reach %s at %s", url, ipAddresses[0]))
 	} else {
-		ipAddress := string(dns.Resolve(url, "A"))
-		fmt.Println(ipAddress)
+		ipAddresses, err := dns.Resolve(url, "A")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, ipAddress := range ipAddresses {
+			fmt.Println(ipAddress)
+		}
 	}
 }